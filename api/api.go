@@ -1,50 +1,146 @@
 package api
 
 import (
+	"a21hc3NpZ25tZW50/model"
+	"a21hc3NpZ25tZW50/repository"
 	"a21hc3NpZ25tZW50/service"
-	"fmt"
+	"context"
+	"crypto/rand"
+	"log/slog"
 	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type API struct {
-	userService    service.UserService
-	sessionService service.SessionService
-	studentService service.StudentService
-	classService   service.ClassService
-	mux            *http.ServeMux
+	userService      service.UserService
+	sessionService   service.SessionService
+	studentService   service.StudentService
+	classService     service.ClassService
+	apiKeyService    service.APIKeyService
+	tokenService     service.TokenService
+	loginGuard       service.LoginGuard
+	resetGuard       service.ResetGuard
+	twoFactorService service.TwoFactorService
+	auditService     service.AuditService
+	healthService    service.HealthService
+	sessionReaper    service.SessionReaper
+	transactor       repository.Transactor
+	config           model.APIConfig
+	csrfKey          []byte
+	logger           *slog.Logger
+	metrics          *metrics
+	draining         *atomic.Bool
+	mux              *http.ServeMux
+	handler          http.Handler
+	routes           []Route
+	server           *http.Server
 }
 
-func NewAPI(userService service.UserService, sessionService service.SessionService, studentService service.StudentService, classService service.ClassService) API {
-	mux := http.NewServeMux()
-	api := API{
-		userService,
-		sessionService,
-		studentService,
-		classService,
-		mux,
+// Services are the dependencies of the handlers. Tests may leave out the
+// ones the routes they exercise never reach.
+type Services struct {
+	User          service.UserService
+	Session       service.SessionService
+	Student       service.StudentService
+	Class         service.ClassService
+	APIKey        service.APIKeyService
+	Token         service.TokenService
+	LoginGuard    service.LoginGuard
+	ResetGuard    service.ResetGuard
+	TwoFactor     service.TwoFactorService
+	Audit         service.AuditService
+	Health        service.HealthService
+	SessionReaper service.SessionReaper
+	Transactor    repository.Transactor
+}
+
+func NewAPI(services Services, config model.APIConfig) API {
+	if config.Cookie.Path == "" {
+		config.Cookie.Path = "/"
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	if config.RequestTimeout <= 0 {
+		config.RequestTimeout = 10 * time.Second
 	}
 
-	mux.Handle("/user/register", api.Post(http.HandlerFunc(api.Register)))
-	mux.Handle("/user/login", api.Post(http.HandlerFunc(api.Login)))
-	mux.Handle("/user/logout", api.Get(api.Auth(http.HandlerFunc(api.Logout))))
+	// main refuses to start without CSRFSecret; the random key is for tests.
+	csrfKey := []byte(config.CSRFSecret)
+	if len(csrfKey) == 0 {
+		csrfKey = make([]byte, 32)
+		rand.Read(csrfKey)
+	}
 
-	mux.Handle("/student/get-all", api.Get(api.Auth(http.HandlerFunc(api.FetchAllStudent))))
-	mux.Handle("/student/get", api.Get(api.Auth(http.HandlerFunc(api.FetchStudentByID))))
-	mux.Handle("/student/add", api.Post(api.Auth(http.HandlerFunc(api.Storestudent))))
-	mux.Handle("/student/update", api.Put(api.Auth(http.HandlerFunc(api.Updatestudent))))
-	mux.Handle("/student/delete", api.Delete(http.HandlerFunc(api.Deletestudent)))
-	mux.Handle("/student/get-with-class", api.Get(http.HandlerFunc(api.FetchStudentWithClass)))
+	mux := http.NewServeMux()
+	api := API{
+		userService:      services.User,
+		sessionService:   services.Session,
+		studentService:   services.Student,
+		classService:     services.Class,
+		apiKeyService:    services.APIKey,
+		tokenService:     services.Token,
+		loginGuard:       services.LoginGuard,
+		resetGuard:       services.ResetGuard,
+		twoFactorService: services.TwoFactor,
+		auditService:     services.Audit,
+		healthService:    services.Health,
+		sessionReaper:    services.SessionReaper,
+		transactor:       services.Transactor,
+		config:           config,
+		csrfKey:          csrfKey,
+		logger:           config.Logger,
+		draining:         &atomic.Bool{},
+		mux:              mux,
+		server:           &http.Server{Addr: ":8080"},
+	}
+	registry := config.Metrics
+	if registry == nil {
+		registry = prometheus.NewRegistry()
+	}
+	api.metrics = api.newMetrics(registry)
+	api.handler = api.Log(api.Deadline(methodNotAllowed(mux)))
+	api.server.Handler = api.handler
 
-	mux.Handle("/class/get-all", api.Get(api.Auth(http.HandlerFunc(api.FetchAllClass))))
+	routes := api.routeTable()
+	if err := checkRoutes(routes); err != nil {
+		panic(err)
+	}
+	for _, route := range routes {
+		api.register(route)
+	}
 
 	return api
 }
 
-func (api *API) Handler() *http.ServeMux {
-	return api.mux
+// Routes returns the route table NewAPI registered.
+func (api *API) Routes() []Route {
+	return api.routes
+}
+
+func (api *API) Handler() http.Handler {
+	return api.handler
 }
 
 func (api *API) Start() {
-	fmt.Println("starting web server at http://localhost:8080")
-	http.ListenAndServe(":8080", api.Handler())
+	api.logger.Info("starting web server", "addr", api.server.Addr)
+	if err := api.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		api.logger.Error("web server stopped", "err", err)
+	}
+}
+
+// Shutdown marks the server not ready, gives load balancers DrainDelay to
+// notice through /readyz, then stops accepting new connections and waits for
+// in-flight requests to finish or for ctx to expire.
+func (api *API) Shutdown(ctx context.Context) error {
+	api.draining.Store(true)
+
+	select {
+	case <-time.After(api.config.DrainDelay):
+	case <-ctx.Done():
+	}
+	return api.server.Shutdown(ctx)
 }
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"encoding/json"
+	"net/http"
+)
+
+// ListAuditEvents returns the audit log newest first, filtered by the entity,
+// id, actor and action query parameters.
+func (api *API) ListAuditEvents(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryInt(r, "limit", 50)
+	if err != nil || limit <= 0 || limit > 200 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "limit must be between 1 and 200"})
+		return
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil || offset < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "offset must not be negative"})
+		return
+	}
+
+	query := r.URL.Query()
+	filter := model.AuditFilter{
+		Entity:   query.Get("entity"),
+		EntityID: query.Get("id"),
+		Actor:    query.Get("actor"),
+		Action:   query.Get("action"),
+	}
+	if filter.EntityID != "" && filter.Entity == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "id requires entity"})
+		return
+	}
+
+	events, err := api.auditService.List(r.Context(), filter, limit, offset)
+	if denied(w, err) || unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(events)
+}
@@ -6,7 +6,10 @@ import (
 )
 
 func (api *API) FetchAllClass(w http.ResponseWriter, r *http.Request) {
-	classes, err := api.classService.FetchAll()
+	classes, err := api.classService.FetchAll(r.Context())
+	if unavailable(w, err) {
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"encoding/json"
+	"net/http"
+)
+
+// Healthz reports that the process is up and serving; it checks nothing else.
+func (api *API) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(model.Readiness{Status: model.HealthOK})
+}
+
+// Readyz reports whether the server can take traffic: the database answers,
+// its schema is migrated and the default classes exist. It is not ready as
+// soon as a graceful shutdown begins. The route is public, so it only names
+// the checks and their status; failures are logged and the details are
+// served to admins by Readiness.
+func (api *API) Readyz(w http.ResponseWriter, r *http.Request) {
+	if api.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(model.Readiness{Status: model.HealthDraining})
+		return
+	}
+
+	readiness := api.healthService.Ready(r.Context())
+	public := model.Readiness{Status: readiness.Status}
+	for _, check := range readiness.Checks {
+		if check.Status != model.HealthOK {
+			api.logger.Warn("readiness check failing", "check", check.Name, "err", check.Error)
+		}
+		public.Checks = append(public.Checks, model.HealthCheck{Name: check.Name, Status: check.Status})
+	}
+	api.writeReadiness(w, public)
+}
+
+// Readiness is Readyz with the latency and error of every check.
+func (api *API) Readiness(w http.ResponseWriter, r *http.Request) {
+	api.writeReadiness(w, api.healthService.Ready(r.Context()))
+}
+
+func (api *API) writeReadiness(w http.ResponseWriter, readiness model.Readiness) {
+	if readiness.Status != model.HealthReady {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	json.NewEncoder(w).Encode(readiness)
+}
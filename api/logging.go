@@ -0,0 +1,112 @@
+package api
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// accessLog collects what the inner handlers learn about a request, the
+// matched route, its trace and the authenticated user, for the log line
+// written once the request is done.
+type accessLog struct {
+	route   string
+	traceID string
+	user    string
+}
+
+type accessLogKey struct{}
+
+func accessLogFrom(ctx context.Context) *accessLog {
+	entry, _ := ctx.Value(accessLogKey{}).(*accessLog)
+	return entry
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Log assigns every request an ID, taken from a well-formed X-Request-ID
+// header or generated, and echoes it in the response. The request context
+// carries the ID, the client IP and a logger tagged with the ID, and the
+// request is logged with its route, status, latency and user once served
+// and counted in the request metrics.
+func (api *API) Log(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		entry := &accessLog{}
+		logger := api.logger.With("request_id", id)
+		ctx := model.WithRequestInfo(r.Context(), model.RequestInfo{ID: id, IP: clientIP(r)})
+		ctx = model.WithLogger(ctx, logger)
+		ctx = context.WithValue(ctx, accessLogKey{}, entry)
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		elapsed := time.Since(start)
+		api.metrics.observeRequest(r.Method, entry.route, recorder.status, elapsed)
+		logger.Info("request",
+			"method", r.Method,
+			"route", entry.route,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"latency_ms", float64(elapsed.Microseconds())/1000,
+			"user", entry.user,
+			"ip", clientIP(r),
+			"trace_id", entry.traceID,
+		)
+	})
+}
+
+// logRoute records the pattern of the route that matched the request.
+func logRoute(pattern string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if entry := accessLogFrom(r.Context()); entry != nil {
+			entry.route = pattern
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	loginSuccess  = "success"
+	loginFailure  = "failure"
+	loginLocked   = "locked"
+	loginDisabled = "disabled"
+)
+
+type metrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+	logins   *prometheus.CounterVec
+}
+
+// newMetrics registers the HTTP, login and session metrics on registry.
+// Requests are labelled with the route pattern that matched, never the raw
+// path, so the number of series stays bounded.
+func (api *API) newMetrics(registry *prometheus.Registry) *metrics {
+	m := &metrics{
+		registry: registry,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests by route and status.",
+		}, []string{"method", "route", "status"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "HTTP request latency by route.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "logins_total",
+			Help: "Login attempts by result.",
+		}, []string{"result"}),
+	}
+	registry.MustRegister(m.requests, m.latency, m.logins)
+
+	// The count comes from the reaper's last pass, so scrapes never query
+	// the database.
+	if api.sessionReaper != nil {
+		registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "sessions_active",
+			Help: "Sessions that were not expired at the last session reaper run.",
+		}, func() float64 {
+			stats := api.sessionReaper.Stats()
+			if stats.LastRunAt.IsZero() || stats.Error != "" {
+				return math.NaN()
+			}
+			return float64(stats.Active)
+		}))
+	}
+
+	return m
+}
+
+func (m *metrics) observeRequest(method, route string, status int, elapsed time.Duration) {
+	if route == "" {
+		route = "unmatched"
+	}
+	m.requests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+	m.latency.WithLabelValues(method, route).Observe(elapsed.Seconds())
+}
+
+func (m *metrics) login(result string) {
+	m.logins.WithLabelValues(result).Inc()
+}
+
+func (api *API) Metrics(w http.ResponseWriter, r *http.Request) {
+	promhttp.HandlerFor(api.metrics.registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
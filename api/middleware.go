@@ -2,79 +2,290 @@ package api
 
 import (
 	"a21hc3NpZ25tZW50/model"
+	"a21hc3NpZ25tZW50/repository"
+	"a21hc3NpZ25tZW50/service"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strings"
+
+	"gorm.io/gorm"
 )
 
+// Auth resolves the caller from an "Authorization: Bearer" header, which may
+// carry an API key or a session token, or else from the session_token cookie.
+// In JWT mode session tokens are signed access tokens verified without a
+// session lookup. The caller is stored in the request context as a
+// model.Principal; disabled and deleted users are turned away.
 func (api *API) Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie("session_token")
+		principal, status, err := api.authenticate(w, r)
+		if unavailable(w, err) {
+			return
+		}
+		if status == http.StatusInternalServerError {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+			return
+		}
 		if err != nil {
-			if err == http.ErrNoCookie {
-				w.WriteHeader(http.StatusUnauthorized)
-				json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Access tokens carry the role, checked at issue time; disabling or
+		// deleting a user revokes their tokens instead.
+		if principal.Method != model.AuthMethodJWT {
+			user, ok := api.activeUser(w, r.Context(), principal.Username)
+			if !ok {
 				return
 			}
+			principal.UserID = user.ID
+			principal.Roles = []string{user.Role}
+		}
+		if entry := accessLogFrom(r.Context()); entry != nil {
+			entry.user = principal.Username
+		}
 
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
-			return
+		next.ServeHTTP(w, r.WithContext(model.WithPrincipal(r.Context(), principal)))
+	})
+}
+
+// activeUser fetches a user who may still sign in, or writes a 401 when the
+// account is disabled or gone.
+func (api *API) activeUser(w http.ResponseWriter, ctx context.Context, username string) (model.User, bool) {
+	user, err := api.userService.FetchByUsername(ctx, username)
+	if unavailable(w, err) {
+		return model.User{}, false
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return model.User{}, false
+	}
+	if err != nil || user.Disabled {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Account is disabled or no longer exists"})
+		return model.User{}, false
+	}
+	return user, true
+}
+
+func (api *API) authenticate(w http.ResponseWriter, r *http.Request) (model.Principal, int, error) {
+	token, fromCookie, err := sessionToken(r)
+	if err != nil {
+		return model.Principal{}, http.StatusUnauthorized, err
+	}
+
+	if !fromCookie && api.apiKeyService.IsAPIKey(token) {
+		apiKey, err := api.apiKeyService.Authenticate(r.Context(), token)
+		if errors.Is(err, service.ErrInvalidAPIKey) || errors.Is(err, service.ErrAPIKeyExpired) {
+			return model.Principal{}, http.StatusUnauthorized, err
 		}
-		session := c.Value
+		if err != nil {
+			return model.Principal{}, http.StatusInternalServerError, err
+		}
+		return model.Principal{
+			Username: apiKey.Username,
+			APIKeyID: apiKey.ID,
+			Method:   model.AuthMethodAPIKey,
+			Scopes:   apiKey.Scopes,
+		}, 0, nil
+	}
 
-		sessionFound, err := api.sessionService.TokenValidity(session)
+	if api.tokenService != nil {
+		claims, err := api.tokenService.VerifyAccessToken(r.Context(), token)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
-			return
+			return model.Principal{}, http.StatusUnauthorized, err
 		}
+		return model.Principal{
+			UserID:    claims.UserID,
+			Username:  claims.Subject,
+			Roles:     []string{claims.Role},
+			SessionID: claims.SessionID,
+			Method:    model.AuthMethodJWT,
+		}, 0, nil
+	}
+
+	sessionFound, err := api.sessionService.TokenValidity(r.Context(), token)
+	if err != nil {
+		return model.Principal{}, http.StatusUnauthorized, err
+	}
+
+	sessionFound, extended, err := api.sessionService.ExtendSession(r.Context(), sessionFound)
+	if err != nil {
+		return model.Principal{}, http.StatusInternalServerError, err
+	}
+	if extended && fromCookie {
+		api.setSessionCookie(w, sessionFound.Token, sessionFound.Expiry)
+	}
+
+	return model.Principal{
+		Username:  sessionFound.Username,
+		SessionID: sessionFound.ID,
+		Method:    model.AuthMethodSession,
+	}, 0, nil
+}
+
+// denied writes a 401 or 403 when a service refused the caller, and reports
+// whether it did.
+func denied(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, service.ErrUnauthenticated):
+		w.WriteHeader(http.StatusUnauthorized)
+	case errors.Is(err, service.ErrForbidden):
+		w.WriteHeader(http.StatusForbidden)
+	default:
+		return false
+	}
+	json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
+	return true
+}
+
+// unavailable writes a 504 when the request ran out of time, or a 503 when it
+// was cancelled or the database could not be reached, and reports whether it
+// did.
+func unavailable(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		w.WriteHeader(http.StatusGatewayTimeout)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Request timed out"})
+	case errors.Is(err, context.Canceled) || repository.Unavailable(err):
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Service Unavailable"})
+	default:
+		return false
+	}
+	return true
+}
 
-		ctx := context.WithValue(r.Context(), "username", sessionFound.Username)
+// Deadline bounds every request, and with it every query the request runs,
+// by the configured request timeout.
+func (api *API) Deadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), api.config.RequestTimeout)
+		defer cancel()
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-func (api *API) Get(next http.Handler) http.Handler {
+// principal returns the caller that Auth stored in the request context.
+func principal(r *http.Request) model.Principal {
+	p, _ := model.PrincipalFrom(r.Context())
+	return p
+}
+
+// Scope rejects API-key callers whose key was not granted scope. Session
+// callers act as the user themselves and hold every scope.
+func (api *API) Scope(scope string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Method is not allowed!"})
+		if !principal(r).HasScope(scope) {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(model.ErrorResponse{Error: "API key is missing scope " + scope})
 			return
 		}
 		next.ServeHTTP(w, r)
 	})
 }
 
-func (api *API) Post(next http.Handler) http.Handler {
+// RequireRole lets the request through only when the authenticated user has
+// the given role.
+func (api *API) RequireRole(role string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Method is not allowed!"})
+		if !principal(r).HasRole(role) {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Forbidden"})
 			return
 		}
+
 		next.ServeHTTP(w, r)
 	})
 }
 
-func (api *API) Delete(next http.Handler) http.Handler {
+// RequireTwoFactor blocks users whose role requires two-factor
+// authentication until they have enrolled. Enrolled users can only sign in
+// through the two-factor challenge, so their sessions are already verified.
+func (api *API) RequireTwoFactor(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodDelete {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Method is not allowed!"})
+		status, err := api.twoFactorService.Status(r.Context())
+		if unavailable(w, err) {
 			return
 		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+			return
+		}
+		if status.Required && !status.Enabled {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Two-factor authentication is required for your role, enroll at /user/2fa/enroll"})
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
 
-func (api *API) Put(next http.Handler) http.Handler {
+// sessionToken returns the bearer token from the Authorization header, or the
+// session_token cookie when no header is present.
+func sessionToken(r *http.Request) (token string, fromCookie bool, err error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, found := strings.Cut(header, " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return "", false, errors.New("malformed Authorization header")
+		}
+		return token, false, nil
+	}
+
+	c, err := r.Cookie("session_token")
+	if err != nil {
+		return "", false, err
+	}
+	return c.Value, true, nil
+}
+
+// CSRF protects cookie-authenticated, state-changing requests with a signed
+// double-submit token: the csrf_token cookie holds an HMAC of the session
+// token (refresh_csrf_token of the refresh token in JWT mode), and the client
+// must echo it back in the X-CSRF-Token header.
+// Requests without a session cookie carry no ambient credentials and pass.
+func (api *API) CSRF(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPut {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Method is not allowed!"})
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// In JWT mode the refresh_token cookie outlives the access token and
+		// its CSRF cookie, so a refresh is checked against the refresh token.
+		c, err := r.Cookie("refresh_token")
+		if err != nil || api.tokenService == nil {
+			c, err = r.Cookie("session_token")
+		}
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		expected := api.csrfToken(c.Value)
+		if !hmac.Equal([]byte(r.Header.Get("X-CSRF-Token")), []byte(expected)) {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Invalid CSRF Token"})
 			return
 		}
+
 		next.ServeHTTP(w, r)
 	})
 }
+
+func (api *API) csrfToken(sessionToken string) string {
+	mac := hmac.New(sha256.New, api.csrfKey)
+	mac.Write([]byte(sessionToken))
+	return hex.EncodeToString(mac.Sum(nil))
+}
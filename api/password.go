@@ -0,0 +1,187 @@
+package api
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"a21hc3NpZ25tZW50/service"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// ChangePassword sets a new password after checking the current one, then
+// signs out every other session of the user.
+func (api *API) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	caller := principal(r)
+
+	var request model.PasswordChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.CurrentPassword == "" || request.NewPassword == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Bad Request"})
+		return
+	}
+	if api.passwordLocked(w, r, caller.Username) {
+		return
+	}
+
+	err := api.transactor.Transaction(r.Context(), func(ctx context.Context) error {
+		if err := api.userService.ChangePassword(ctx, request); err != nil {
+			return err
+		}
+		return api.revokeOtherSessions(ctx, caller.Username, caller.SessionID)
+	})
+	if errors.Is(err, service.ErrWrongPassword) {
+		api.wrongPassword(w, r, caller.Username, "Current password is incorrect")
+		return
+	}
+	if policyViolated(w, err) {
+		return
+	}
+	if unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(model.SuccessResponse{Username: caller.Username, Message: "Password Changed"})
+}
+
+// RequestPasswordReset always answers 202, whether or not the user exists.
+// Requests are throttled per IP; past the per-username cap the request is
+// still accepted but no further token is sent, so the endpoint can neither
+// flood a user's inbox nor lock the owner out of resetting.
+func (api *API) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var request model.PasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Username == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Bad Request"})
+		return
+	}
+
+	ip := clientIP(r)
+	notify := false
+	retryAfter, err := api.resetGuard.Check(r.Context(), ip)
+	if err == nil && retryAfter == 0 {
+		notify, err = api.resetGuard.Record(r.Context(), request.Username, ip)
+	}
+	if unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+	if retryAfter > 0 {
+		retryLater(w, retryAfter, "Too many password reset requests, please try again later")
+		return
+	}
+
+	if notify {
+		err = api.userService.RequestPasswordReset(r.Context(), request.Username)
+		if unavailable(w, err) {
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(model.SuccessResponse{Message: "If the account exists, a reset token has been sent"})
+}
+
+// ResetPassword sets a new password from a reset token. Every session of the
+// user is revoked and any login lockout is lifted.
+func (api *API) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var request model.PasswordResetConfirm
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Token == "" || request.NewPassword == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Bad Request"})
+		return
+	}
+
+	var username string
+	err := api.transactor.Transaction(r.Context(), func(ctx context.Context) error {
+		var err error
+		username, err = api.userService.ResetPassword(ctx, request)
+		if err != nil {
+			return err
+		}
+		if err := api.revokeAllSessions(ctx, username); err != nil {
+			return err
+		}
+		return api.loginGuard.Unlock(ctx, username)
+	})
+	if errors.Is(err, service.ErrInvalidResetToken) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
+		return
+	}
+	if policyViolated(w, err) {
+		return
+	}
+	if unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(model.SuccessResponse{Username: username, Message: "Password Reset"})
+}
+
+// passwordLocked answers 429 when the login guard has locked out the user or
+// the client IP, so a stolen session can't be used to guess the password
+// through the endpoints that re-check it.
+func (api *API) passwordLocked(w http.ResponseWriter, r *http.Request, username string) bool {
+	retryAfter, err := api.loginGuard.Check(r.Context(), username, clientIP(r))
+	if unavailable(w, err) {
+		return true
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return true
+	}
+	if retryAfter > 0 {
+		tooManyAttempts(w, retryAfter)
+		return true
+	}
+	return false
+}
+
+// wrongPassword counts a failed password check like a failed login and
+// answers 403, or 429 once that locks the user out.
+func (api *API) wrongPassword(w http.ResponseWriter, r *http.Request, username, message string) {
+	retryAfter, _ := api.loginGuard.RecordFailure(r.Context(), username, clientIP(r))
+	if retryAfter > 0 {
+		tooManyAttempts(w, retryAfter)
+		return
+	}
+
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(model.ErrorResponse{Error: message})
+}
+
+// policyViolated writes a 400 listing the broken password rules if err is a
+// password policy error.
+func policyViolated(w http.ResponseWriter, err error) bool {
+	var policyErr *service.PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		return false
+	}
+
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(model.PasswordPolicyResponse{Error: "Password does not meet the policy", Violations: policyErr.Violations})
+	return true
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"a21hc3NpZ25tZW50/service"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+func (api *API) Me(w http.ResponseWriter, r *http.Request) {
+	profile, err := api.userService.Profile(r.Context())
+	if unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(profile)
+}
+
+func (api *API) UpdateMe(w http.ResponseWriter, r *http.Request) {
+	var update model.ProfileUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Bad Request"})
+		return
+	}
+
+	profile, err := api.userService.UpdateProfile(r.Context(), update)
+	if errors.Is(err, service.ErrInvalidProfile) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
+		return
+	}
+	if unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(profile)
+}
+
+// DeleteMe deletes the caller's account after confirming their password,
+// together with everything that let them act as that user, in one
+// transaction.
+func (api *API) DeleteMe(w http.ResponseWriter, r *http.Request) {
+	username := principal(r).Username
+
+	var request model.AccountDeleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Password == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Bad Request"})
+		return
+	}
+	if api.passwordLocked(w, r, username) {
+		return
+	}
+
+	err := api.transactor.Transaction(r.Context(), func(ctx context.Context) error {
+		if err := api.userService.DeleteAccount(ctx, request.Password); err != nil {
+			return err
+		}
+		if err := api.revokeAllSessions(ctx, username); err != nil {
+			return err
+		}
+		if err := api.apiKeyService.RevokeAll(ctx, username); err != nil {
+			return err
+		}
+		if err := api.twoFactorService.Reset(ctx, username); err != nil {
+			return err
+		}
+		return api.loginGuard.Unlock(ctx, username)
+	})
+	if errors.Is(err, service.ErrWrongPassword) {
+		api.wrongPassword(w, r, username, "Password is incorrect")
+		return
+	}
+	if unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	api.clearSessionCookie(w)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(model.SuccessResponse{Username: username, Message: "Account Deleted"})
+}
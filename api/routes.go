@@ -0,0 +1,180 @@
+package api
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Route declares an endpoint together with what a caller needs to reach it.
+// Every route is authenticated unless it is explicitly Public; Scope is the
+// permission an API key must hold, Role and TwoFactor restrict the user
+// further, and CSRF requires the double-submit token on cookie sessions.
+type Route struct {
+	Pattern   string
+	Public    bool
+	Scope     string
+	Role      string
+	TwoFactor bool
+	CSRF      bool
+
+	handler http.HandlerFunc
+}
+
+func (api *API) routeTable() []Route {
+	return []Route{
+		{Pattern: "POST /user/register", Public: true, handler: api.Register},
+		{Pattern: "POST /user/login", Public: true, handler: api.Login},
+		{Pattern: "POST /user/login/2fa", Public: true, handler: api.LoginTwoFactor},
+		// Refresh authenticates with the refresh token itself, see API.Refresh.
+		{Pattern: "POST /user/refresh", Public: true, CSRF: true, handler: api.Refresh},
+		{Pattern: "POST /user/password/reset", Public: true, handler: api.RequestPasswordReset},
+		{Pattern: "POST /user/password/reset/confirm", Public: true, handler: api.ResetPassword},
+		{Pattern: "POST /user/logout", Scope: model.ScopeAccount, CSRF: true, handler: api.Logout},
+		{Pattern: "GET /user/me", Scope: model.ScopeAccount, handler: api.Me},
+		{Pattern: "PATCH /user/me", Scope: model.ScopeAccount, CSRF: true, handler: api.UpdateMe},
+		{Pattern: "DELETE /user/me", Scope: model.ScopeAccount, CSRF: true, handler: api.DeleteMe},
+		{Pattern: "GET /user/sessions", Scope: model.ScopeAccount, handler: api.ListSessions},
+		{Pattern: "DELETE /user/sessions", Scope: model.ScopeAccount, CSRF: true, handler: api.RevokeAllSessions},
+		{Pattern: "DELETE /user/sessions/{id}", Scope: model.ScopeAccount, CSRF: true, handler: api.RevokeSession},
+		{Pattern: "PUT /user/password", Scope: model.ScopeAccount, CSRF: true, handler: api.ChangePassword},
+		{Pattern: "GET /user/2fa", Scope: model.ScopeAccount, handler: api.TwoFactorStatus},
+		{Pattern: "POST /user/2fa/enroll", Scope: model.ScopeAccount, CSRF: true, handler: api.EnrollTwoFactor},
+		{Pattern: "POST /user/2fa/activate", Scope: model.ScopeAccount, CSRF: true, handler: api.ActivateTwoFactor},
+		{Pattern: "POST /user/2fa/disable", Scope: model.ScopeAccount, CSRF: true, handler: api.DisableTwoFactor},
+		{Pattern: "GET /user/api-keys", Scope: model.ScopeAccount, handler: api.ListAPIKeys},
+		{Pattern: "POST /user/api-keys", Scope: model.ScopeAccount, CSRF: true, handler: api.CreateAPIKey},
+		{Pattern: "DELETE /user/api-keys/{id}", Scope: model.ScopeAccount, CSRF: true, handler: api.RevokeAPIKey},
+
+		// Legacy routes, kept as aliases of the /api/v2 tree during migration.
+		{Pattern: "GET /student/get-all", Scope: model.ScopeStudentsRead, handler: api.FetchAllStudent},
+		{Pattern: "GET /student/get", Scope: model.ScopeStudentsRead, handler: api.FetchStudentByID},
+		{Pattern: "POST /student/add", Scope: model.ScopeStudentsWrite, TwoFactor: true, CSRF: true, handler: api.Storestudent},
+		{Pattern: "PUT /student/update", Scope: model.ScopeStudentsWrite, TwoFactor: true, CSRF: true, handler: api.Updatestudent},
+		{Pattern: "DELETE /student/delete", Scope: model.ScopeStudentsWrite, TwoFactor: true, CSRF: true, handler: api.Deletestudent},
+		{Pattern: "GET /student/get-with-class", Scope: model.ScopeStudentsRead, handler: api.FetchStudentWithClass},
+		{Pattern: "GET /class/get-all", Scope: model.ScopeClassesRead, handler: api.FetchAllClass},
+
+		{Pattern: "GET /student/trash", Scope: model.ScopeStudentsRead, handler: api.FetchStudentTrash},
+		{Pattern: "POST /student/restore", Scope: model.ScopeStudentsWrite, TwoFactor: true, CSRF: true, handler: api.RestoreStudent},
+		{Pattern: "DELETE /student/purge", Scope: model.ScopeStudentsWrite, Role: model.RoleAdmin, TwoFactor: true, CSRF: true, handler: api.PurgeStudent},
+		{Pattern: "DELETE /student/trash", Scope: model.ScopeStudentsWrite, Role: model.RoleAdmin, TwoFactor: true, CSRF: true, handler: api.PurgeStudentTrash},
+
+		{Pattern: "GET /api/v2/students", Scope: model.ScopeStudentsRead, handler: api.FetchAllStudent},
+		{Pattern: "POST /api/v2/students", Scope: model.ScopeStudentsWrite, TwoFactor: true, CSRF: true, handler: api.Storestudent},
+		{Pattern: "GET /api/v2/students/{id}", Scope: model.ScopeStudentsRead, handler: api.FetchStudentByID},
+		{Pattern: "PATCH /api/v2/students/{id}", Scope: model.ScopeStudentsWrite, TwoFactor: true, CSRF: true, handler: api.PatchStudent},
+		{Pattern: "DELETE /api/v2/students/{id}", Scope: model.ScopeStudentsWrite, TwoFactor: true, CSRF: true, handler: api.Deletestudent},
+		{Pattern: "GET /api/v2/students/trash", Scope: model.ScopeStudentsRead, handler: api.FetchStudentTrash},
+		{Pattern: "DELETE /api/v2/students/trash", Scope: model.ScopeStudentsWrite, Role: model.RoleAdmin, TwoFactor: true, CSRF: true, handler: api.PurgeStudentTrash},
+		{Pattern: "POST /api/v2/students/trash/{id}/restore", Scope: model.ScopeStudentsWrite, TwoFactor: true, CSRF: true, handler: api.RestoreStudent},
+		{Pattern: "DELETE /api/v2/students/trash/{id}", Scope: model.ScopeStudentsWrite, Role: model.RoleAdmin, TwoFactor: true, CSRF: true, handler: api.PurgeStudent},
+		{Pattern: "GET /api/v2/classes", Scope: model.ScopeClassesRead, handler: api.FetchAllClass},
+		{Pattern: "GET /api/v2/classes/{id}/students", Scope: model.ScopeStudentsRead, handler: api.FetchStudentsByClass},
+
+		{Pattern: "GET /admin/sessions/reaper", Scope: model.ScopeAccount, Role: model.RoleAdmin, TwoFactor: true, handler: api.SessionReaperStats},
+		{Pattern: "GET /admin/readiness", Scope: model.ScopeAccount, Role: model.RoleAdmin, TwoFactor: true, handler: api.Readiness},
+		{Pattern: "GET /admin/users", Scope: model.ScopeAccount, Role: model.RoleAdmin, TwoFactor: true, handler: api.ListUsers},
+		{Pattern: "POST /admin/users/{username}/disable", Scope: model.ScopeAccount, Role: model.RoleAdmin, TwoFactor: true, CSRF: true, handler: api.DisableUser},
+		{Pattern: "POST /admin/users/{username}/enable", Scope: model.ScopeAccount, Role: model.RoleAdmin, TwoFactor: true, CSRF: true, handler: api.EnableUser},
+		{Pattern: "POST /admin/users/{username}/unlock", Scope: model.ScopeAccount, Role: model.RoleAdmin, TwoFactor: true, CSRF: true, handler: api.UnlockUser},
+		{Pattern: "PUT /admin/roles/{role}/2fa", Scope: model.ScopeAccount, Role: model.RoleAdmin, TwoFactor: true, CSRF: true, handler: api.SetRoleTwoFactor},
+		{Pattern: "GET /audit", Scope: model.ScopeAccount, Role: model.RoleAdmin, TwoFactor: true, handler: api.ListAuditEvents},
+
+		{Pattern: "GET /openapi.json", Public: true, handler: api.OpenAPISpec},
+		{Pattern: "GET /docs", Public: true, handler: api.Docs},
+		{Pattern: "GET /metrics", Scope: model.ScopeMetricsRead, Role: model.RoleAdmin, handler: api.Metrics},
+		{Pattern: "GET /healthz", Public: true, handler: api.Healthz},
+		{Pattern: "GET /readyz", Public: true, handler: api.Readyz},
+	}
+}
+
+// register wraps the handler in the middleware the route asks for. CSRF runs
+// first since it needs no lookups, then Auth, Scope, RequireRole and
+// RequireTwoFactor, all inside the route's trace span.
+func (api *API) register(route Route) {
+	var handler http.Handler = route.handler
+	if route.TwoFactor {
+		handler = api.RequireTwoFactor(handler)
+	}
+	if route.Role != "" {
+		handler = api.RequireRole(route.Role, handler)
+	}
+	if !route.Public {
+		handler = api.Auth(api.Scope(route.Scope, handler))
+	}
+	if route.CSRF {
+		handler = api.CSRF(handler)
+	}
+	handler = traceRoute(route.Pattern, logRoute(route.Pattern, handler))
+
+	api.routes = append(api.routes, route)
+	api.mux.Handle(route.Pattern, handler)
+}
+
+// methodNotAllowed serves requests through mux, turning the plain-text 405
+// the mux writes for a path registered under other methods into a JSON
+// ErrorResponse. The mux has already set the Allow header by then.
+func methodNotAllowed(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		mux.ServeHTTP(&methodNotAllowedWriter{ResponseWriter: w}, r)
+	})
+}
+
+type methodNotAllowedWriter struct {
+	http.ResponseWriter
+	replaced bool
+}
+
+func (w *methodNotAllowedWriter) WriteHeader(status int) {
+	if status != http.StatusMethodNotAllowed {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	w.replaced = true
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Del("X-Content-Type-Options")
+	w.ResponseWriter.WriteHeader(status)
+	json.NewEncoder(w.ResponseWriter).Encode(model.ErrorResponse{Error: "Method Not Allowed"})
+}
+
+func (w *methodNotAllowedWriter) Write(b []byte) (int, error) {
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// checkRoutes is run at startup and rejects route tables that would expose
+// an endpoint by mistake.
+func checkRoutes(routes []Route) error {
+	for _, route := range routes {
+		method, path, found := strings.Cut(route.Pattern, " ")
+		if !found || method == "" || !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("route %q must look like \"METHOD /path\"", route.Pattern)
+		}
+		if route.handler == nil {
+			return fmt.Errorf("route %q has no handler", route.Pattern)
+		}
+
+		unsafe := method != http.MethodGet && method != http.MethodHead && method != http.MethodOptions
+		switch {
+		case route.Public && (route.Scope != "" || route.Role != "" || route.TwoFactor):
+			return fmt.Errorf("public route %q cannot require a scope, role or second factor", route.Pattern)
+		case !route.Public && route.Scope == "":
+			return fmt.Errorf("route %q must declare the scope it requires or be marked public", route.Pattern)
+		case !route.Public && unsafe && !route.CSRF:
+			return fmt.Errorf("route %q changes state with a session but is not CSRF protected", route.Pattern)
+		case route.Role != "" && route.Role != model.RoleUser && route.Role != model.RoleAdmin:
+			return fmt.Errorf("route %q requires unknown role %q", route.Pattern, route.Role)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package api
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func (api *API) ListSessions(w http.ResponseWriter, r *http.Request) {
+	caller := principal(r)
+
+	sessions, err := api.sessionService.ListSessions(r.Context(), caller.Username)
+	if unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	infos := make([]model.SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, model.SessionInfo{
+			ID:        session.ID,
+			UserAgent: session.UserAgent,
+			IP:        session.IP,
+			CreatedAt: session.CreatedAt,
+			Expiry:    session.Expiry,
+			Current:   session.ID == caller.SessionID,
+		})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(infos)
+}
+
+func (api *API) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	username := principal(r).Username
+
+	id, err := idParam(r)
+	if err != nil || id <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Bad Request"})
+		return
+	}
+
+	err = api.sessionService.RevokeSession(r.Context(), username, uint(id))
+	if err == nil && api.tokenService != nil {
+		err = api.tokenService.RevokeSession(r.Context(), uint(id))
+	}
+	if unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Session not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(model.SuccessResponse{Username: username, Message: "Session Revoked"})
+}
+
+func (api *API) RevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	username := principal(r).Username
+
+	err := api.revokeAllSessions(r.Context(), username)
+	if unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	api.clearSessionCookie(w)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(model.SuccessResponse{Username: username, Message: "Logged Out Everywhere"})
+}
+
+// revokeAllSessions deletes every session of the user. In JWT mode the
+// sessions are also put on the revocation list, since their access tokens
+// would otherwise stay valid until they expire.
+func (api *API) revokeAllSessions(ctx context.Context, username string) error {
+	if err := api.revokeAccessTokens(ctx, username, 0); err != nil {
+		return err
+	}
+	return api.sessionService.RevokeAllSessions(ctx, username)
+}
+
+// revokeOtherSessions is revokeAllSessions except for the session keepID.
+func (api *API) revokeOtherSessions(ctx context.Context, username string, keepID uint) error {
+	if err := api.revokeAccessTokens(ctx, username, keepID); err != nil {
+		return err
+	}
+	return api.sessionService.RevokeOtherSessions(ctx, username, keepID)
+}
+
+func (api *API) revokeAccessTokens(ctx context.Context, username string, keepID uint) error {
+	if api.tokenService == nil {
+		return nil
+	}
+
+	sessions, err := api.sessionService.ListSessions(ctx, username)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if session.ID == keepID {
+			continue
+		}
+		if err := api.tokenService.RevokeSession(ctx, session.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (api *API) SessionReaperStats(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(api.sessionReaper.Stats())
+}
+
+// writeSession completes a login or refresh. In opaque mode the session
+// token itself goes into the session_token cookie. In JWT mode the cookie
+// carries a signed access token, the session token becomes the refresh token
+// in its own cookie scoped to /user/refresh, and both are returned in the body.
+func (api *API) writeSession(w http.ResponseWriter, r *http.Request, session model.Session, message string) {
+	if api.tokenService == nil {
+		api.setSessionCookie(w, session.Token, session.Expiry)
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(model.SuccessResponse{Username: session.Username, Message: message})
+		return
+	}
+
+	user, ok := api.activeUser(w, r.Context(), session.Username)
+	if !ok {
+		return
+	}
+
+	accessToken, expiresAt, err := api.tokenService.IssueAccessToken(r.Context(), session, user)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	api.setSessionCookie(w, accessToken, expiresAt)
+	refresh := api.cookie("refresh_token", session.Token, session.Expiry, true)
+	refresh.Path = refreshCookiePath
+	http.SetCookie(w, refresh)
+	http.SetCookie(w, api.cookie("refresh_csrf_token", api.csrfToken(session.Token), session.Expiry, false))
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(model.TokenPair{
+		Username:         session.Username,
+		AccessToken:      accessToken,
+		TokenType:        "Bearer",
+		ExpiresAt:        expiresAt,
+		RefreshToken:     session.Token,
+		RefreshExpiresAt: session.Expiry,
+	})
+}
+
+const refreshCookiePath = "/user/refresh"
+
+func (api *API) setSessionCookie(w http.ResponseWriter, token string, expires time.Time) {
+	http.SetCookie(w, api.cookie("session_token", token, expires, true))
+	http.SetCookie(w, api.cookie("csrf_token", api.csrfToken(token), expires, false))
+}
+
+// clearSessionCookie expires the session, refresh and both CSRF cookies. Path and
+// Domain must match the ones they were set with, or the browser keeps the
+// originals.
+func (api *API) clearSessionCookie(w http.ResponseWriter) {
+	for _, name := range []string{"session_token", "csrf_token", "refresh_token", "refresh_csrf_token"} {
+		c := api.cookie(name, "", time.Unix(0, 0), !strings.HasSuffix(name, "csrf_token"))
+		if name == "refresh_token" {
+			c.Path = refreshCookiePath
+		}
+		c.MaxAge = -1
+		http.SetCookie(w, c)
+	}
+}
+
+func (api *API) cookie(name, value string, expires time.Time, httpOnly bool) *http.Cookie {
+	cfg := api.config.Cookie
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     cfg.Path,
+		Domain:   cfg.Domain,
+		Expires:  expires,
+		Secure:   cfg.Secure,
+		HttpOnly: httpOnly && cfg.HttpOnly,
+		SameSite: sameSite(cfg.SameSite),
+	}
+}
+
+func sameSite(mode string) http.SameSite {
+	switch strings.ToLower(mode) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	case "lax":
+		return http.SameSiteLaxMode
+	default:
+		return http.SameSiteDefaultMode
+	}
+}
+
+// clientIP returns the address of the peer that sent the request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
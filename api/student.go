@@ -2,13 +2,22 @@ package api
 
 import (
 	"a21hc3NpZ25tZW50/model"
+	"a21hc3NpZ25tZW50/service"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
 )
 
 func (api *API) FetchAllStudent(w http.ResponseWriter, r *http.Request) {
-	student, err := api.studentService.FetchAll()
+	student, err := api.studentService.FetchAll(r.Context())
+	if unavailable(w, err) {
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -19,19 +28,22 @@ func (api *API) FetchAllStudent(w http.ResponseWriter, r *http.Request) {
 }
 
 func (api *API) FetchStudentByID(w http.ResponseWriter, r *http.Request) {
-	id := r.URL.Query().Get("id")
-	idInt, err := strconv.Atoi(id)
+	idInt, err := idParam(r)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	student, err := api.studentService.FetchByID(idInt)
+	student, err := api.studentService.FetchByID(r.Context(), idInt)
+	if studentMissing(w, err) || unavailable(w, err) {
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("ETag", studentETag(student))
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(student)
 }
@@ -46,7 +58,10 @@ func (api *API) Storestudent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = api.studentService.Store(&student)
+	err = api.studentService.Store(r.Context(), &student)
+	if denied(w, err) || unavailable(w, err) {
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
@@ -57,14 +72,22 @@ func (api *API) Storestudent(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(student)
 }
 
+// Updatestudent requires an If-Match header carrying the ETag the client
+// last read, so that concurrent edits cannot silently overwrite each other.
 func (api *API) Updatestudent(w http.ResponseWriter, r *http.Request) {
-	id := r.URL.Query().Get("id")
-	idInt, err := strconv.Atoi(id)
+	idInt, err := idParam(r)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	version, ok := ifMatchVersion(r)
+	if !ok {
+		w.WriteHeader(http.StatusPreconditionRequired)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "If-Match header with the student's ETag is required"})
+		return
+	}
+
 	var student model.Student
 	err = json.NewDecoder(r.Body).Decode(&student)
 	if err != nil {
@@ -73,26 +96,112 @@ func (api *API) Updatestudent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = api.studentService.Update(idInt, &student)
+	updated, err := api.studentService.Update(r.Context(), idInt, &student, version)
+	if errors.Is(err, service.ErrStudentChanged) {
+		api.studentChanged(w, r, idInt)
+		return
+	}
+	if denied(w, err) || studentMissing(w, err) || unavailable(w, err) {
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.Header().Set("ETag", studentETag(updated))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(updated)
+}
+
+// PatchStudent applies a JSON Merge Patch (RFC 7396) to the student and
+// returns it as stored. Like Updatestudent it requires If-Match.
+func (api *API) PatchStudent(w http.ResponseWriter, r *http.Request) {
+	idInt, err := idParam(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	mediaType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	switch strings.TrimSpace(mediaType) {
+	case "", "application/json", "application/merge-patch+json":
+	default:
+		w.Header().Set("Accept-Patch", "application/merge-patch+json")
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Content-Type must be application/merge-patch+json"})
+		return
+	}
+
+	version, ok := ifMatchVersion(r)
+	if !ok {
+		w.WriteHeader(http.StatusPreconditionRequired)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "If-Match header with the student's ETag is required"})
+		return
+	}
+
+	var patch model.StudentPatch
+	err = json.NewDecoder(r.Body).Decode(&patch)
+	if err != nil || patch == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Body must be a JSON object"})
+		return
+	}
+
+	updated, err := api.studentService.Patch(r.Context(), idInt, patch, version)
+	if errors.Is(err, service.ErrInvalidPatch) {
+		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
 		return
 	}
+	if errors.Is(err, service.ErrStudentChanged) {
+		api.studentChanged(w, r, idInt)
+		return
+	}
+	if denied(w, err) || studentMissing(w, err) || unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
 
+	w.Header().Set("ETag", studentETag(updated))
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(student)
+	json.NewEncoder(w).Encode(updated)
+}
+
+// studentChanged answers a write based on a stale version with 412 and the
+// student as it is now, so the client can merge and retry.
+func (api *API) studentChanged(w http.ResponseWriter, r *http.Request, id int) {
+	current, err := api.studentService.FetchByID(r.Context(), id)
+	if studentMissing(w, err) || unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.Header().Set("ETag", studentETag(current))
+	w.WriteHeader(http.StatusPreconditionFailed)
+	json.NewEncoder(w).Encode(current)
 }
 
 func (api *API) Deletestudent(w http.ResponseWriter, r *http.Request) {
-	id := r.URL.Query().Get("id")
-	idInt, err := strconv.Atoi(id)
+	idInt, err := idParam(r)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	err = api.studentService.Delete(idInt)
+	err = api.studentService.Delete(r.Context(), idInt)
+	if denied(w, err) || studentMissing(w, err) || unavailable(w, err) {
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
@@ -104,7 +213,10 @@ func (api *API) Deletestudent(w http.ResponseWriter, r *http.Request) {
 }
 
 func (api *API) FetchStudentWithClass(w http.ResponseWriter, r *http.Request) {
-	studentClasses, err := api.studentService.FetchWithClass()
+	studentClasses, err := api.studentService.FetchWithClass(r.Context())
+	if unavailable(w, err) {
+		return
+	}
 	if err != nil {
 		json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
 		return
@@ -113,3 +225,189 @@ func (api *API) FetchStudentWithClass(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(studentClasses)
 }
+
+func (api *API) FetchStudentsByClass(w http.ResponseWriter, r *http.Request) {
+	idInt, err := idParam(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	students, err := api.studentService.FetchByClass(r.Context(), idInt)
+	if unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(students)
+}
+
+func (api *API) FetchStudentTrash(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryInt(r, "limit", 50)
+	if err != nil || limit <= 0 || limit > 200 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "limit must be between 1 and 200"})
+		return
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil || offset < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "offset must not be negative"})
+		return
+	}
+
+	students, err := api.studentService.Trash(r.Context(), limit, offset)
+	if denied(w, err) || unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(students)
+}
+
+func (api *API) RestoreStudent(w http.ResponseWriter, r *http.Request) {
+	idInt, err := idParam(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	student, err := api.studentService.Restore(r.Context(), idInt)
+	if denied(w, err) || trashedStudentMissing(w, err) || unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(student)
+}
+
+func (api *API) PurgeStudent(w http.ResponseWriter, r *http.Request) {
+	idInt, err := idParam(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = api.studentService.Purge(r.Context(), idInt)
+	if denied(w, err) || trashedStudentMissing(w, err) || unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(model.SuccessResponse{Message: "student dihapus permanen"})
+}
+
+// PurgeStudentTrash permanently deletes the students that have been in the
+// trash for longer than ?older_than=, or the configured retention.
+func (api *API) PurgeStudentTrash(w http.ResponseWriter, r *http.Request) {
+	var olderThan time.Duration
+	if value := r.URL.Query().Get("older_than"); value != "" {
+		var err error
+		olderThan, err = time.ParseDuration(value)
+		if err != nil || olderThan <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(model.ErrorResponse{Error: "older_than must be a positive duration such as 720h"})
+			return
+		}
+	}
+
+	purged, err := api.studentService.PurgeTrash(r.Context(), olderThan)
+	if denied(w, err) || unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(model.PurgeResponse{Purged: purged})
+}
+
+func studentETag(student *model.Student) string {
+	return strconv.Quote(strconv.Itoa(student.Version))
+}
+
+// ifMatchVersion returns the version named by the If-Match header, and false
+// when there is no header. "*" matches whatever version the student is at. A
+// weak tag is read as the strong one; our tags are strong, so W/ only appears
+// when something in between weakened it. A tag that is not one of ours yields
+// version 0, which no student is at.
+func ifMatchVersion(r *http.Request) (int, bool) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		return 0, false
+	}
+	if header == "*" {
+		return service.AnyVersion, true
+	}
+
+	tag, err := strconv.Unquote(strings.TrimPrefix(header, "W/"))
+	if err != nil {
+		return 0, true
+	}
+	version, err := strconv.Atoi(tag)
+	if err != nil {
+		return 0, true
+	}
+	return version, true
+}
+
+func studentMissing(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(model.ErrorResponse{Error: "student tidak ditemukan"})
+	return true
+}
+
+func trashedStudentMissing(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(model.ErrorResponse{Error: "student tidak ada di trash"})
+	return true
+}
+
+// idParam reads the resource id from the {id} path segment of the /api/v2
+// routes, falling back to the ?id= query parameter used by the legacy routes.
+func idParam(r *http.Request) (int, error) {
+	id := r.PathValue("id")
+	if id == "" {
+		id = r.URL.Query().Get("id")
+	}
+	return strconv.Atoi(id)
+}
+
+// queryInt reads an integer query parameter, returning fallback when it is
+// absent.
+func queryInt(r *http.Request, name string, fallback int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(value)
+}
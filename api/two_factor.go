@@ -0,0 +1,218 @@
+package api
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"a21hc3NpZ25tZW50/service"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// LoginTwoFactor exchanges the challenge returned by Login and a TOTP or
+// recovery code for a session. Wrong codes count as failed logins and a
+// locked out user or IP is refused before the code is checked, so the lockout
+// also caps guessing at this step.
+func (api *API) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var request model.TwoFactorLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Challenge == "" || request.Code == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Bad Request"})
+		return
+	}
+
+	username, err := api.twoFactorService.ChallengeUsername(r.Context(), request.Challenge)
+	if errors.Is(err, service.ErrInvalidChallenge) {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
+		return
+	}
+	if unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	ip := clientIP(r)
+	retryAfter, err := api.loginGuard.Check(r.Context(), username, ip)
+	if unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+	if retryAfter > 0 {
+		tooManyAttempts(w, retryAfter)
+		return
+	}
+
+	username, err = api.twoFactorService.CompleteChallenge(r.Context(), request.Challenge, request.Code)
+	switch {
+	case errors.Is(err, service.ErrInvalidChallenge):
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
+		return
+	case errors.Is(err, service.ErrInvalidTwoFactorCode):
+		api.metrics.login(loginFailure)
+		retryAfter, _ := api.loginGuard.RecordFailure(r.Context(), username, ip)
+		if retryAfter > 0 {
+			tooManyAttempts(w, retryAfter)
+			return
+		}
+
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
+		return
+	case unavailable(w, err):
+		return
+	case err != nil:
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	api.startSession(w, r, username, "Login Success")
+}
+
+func (api *API) TwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := api.twoFactorService.Status(r.Context())
+	if unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(status)
+}
+
+func (api *API) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	enrollment, err := api.twoFactorService.BeginEnrollment(r.Context(), principal(r).Username)
+	if errors.Is(err, service.ErrTwoFactorAlreadyEnabled) {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
+		return
+	}
+	if unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(enrollment)
+}
+
+// ActivateTwoFactor confirms enrollment with a code from the authenticator
+// and signs out every other session, since those were never challenged.
+func (api *API) ActivateTwoFactor(w http.ResponseWriter, r *http.Request) {
+	caller := principal(r)
+
+	var request model.TwoFactorCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Code == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Bad Request"})
+		return
+	}
+
+	codes, err := api.twoFactorService.Activate(r.Context(), caller.Username, request.Code)
+	if twoFactorError(w, err) {
+		return
+	}
+	if err == nil {
+		err = api.revokeOtherSessions(r.Context(), caller.Username, caller.SessionID)
+	}
+	if unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(model.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+func (api *API) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var request model.TwoFactorCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Code == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Bad Request"})
+		return
+	}
+
+	err := api.twoFactorService.Disable(r.Context(), request.Code)
+	if twoFactorError(w, err) || denied(w, err) || unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(model.SuccessResponse{Username: principal(r).Username, Message: "Two-Factor Authentication Disabled"})
+}
+
+func (api *API) SetRoleTwoFactor(w http.ResponseWriter, r *http.Request) {
+	role := r.PathValue("role")
+
+	var request model.RoleTwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Bad Request"})
+		return
+	}
+
+	if role != model.RoleUser && role != model.RoleAdmin {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Role not found"})
+		return
+	}
+
+	err := api.twoFactorService.SetRequired(r.Context(), role, request.Required)
+	if unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(model.RoleSetting{Role: role, RequireTwoFactor: request.Required})
+}
+
+// twoFactorError maps the client errors of the two-factor service to a
+// response and reports whether it wrote one.
+func twoFactorError(w http.ResponseWriter, err error) bool {
+	status := 0
+	switch {
+	case errors.Is(err, service.ErrInvalidTwoFactorCode):
+		status = http.StatusBadRequest
+	case errors.Is(err, service.ErrTwoFactorNotEnrolled), errors.Is(err, service.ErrTwoFactorAlreadyEnabled):
+		status = http.StatusConflict
+	case errors.Is(err, service.ErrTwoFactorRequired):
+		status = http.StatusForbidden
+	default:
+		return false
+	}
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
+	return true
+}
@@ -2,11 +2,17 @@ package api
 
 import (
 	"a21hc3NpZ25tZW50/model"
+	"a21hc3NpZ25tZW50/service"
+	"context"
 	"encoding/json"
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 func (api *API) Register(w http.ResponseWriter, r *http.Request) {
@@ -24,19 +30,10 @@ func (api *API) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if api.userService.CheckPassLength(creds.Password) {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Please provide a password of more than 5 characters"})
-		return
-	}
-
-	if api.userService.CheckPassAlphabet(creds.Password) {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Please use Password with Contains non Alphabetic Characters"})
+	err = api.userService.Register(r.Context(), creds)
+	if policyViolated(w, err) || unavailable(w, err) {
 		return
 	}
-
-	err = api.userService.Register(creds)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
@@ -63,75 +60,304 @@ func (api *API) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if api.userService.CheckPassLength(creds.Password) {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Please provide a password of more than 5 characters"})
+	ip := clientIP(r)
+	retryAfter, err := api.loginGuard.Check(r.Context(), creds.Username, ip)
+	if unavailable(w, err) {
 		return
 	}
-
-	if api.userService.CheckPassAlphabet(creds.Password) {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Please use Password with Contains non Alphabetic Characters"})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+	if retryAfter > 0 {
+		api.metrics.login(loginLocked)
+		tooManyAttempts(w, retryAfter)
 		return
 	}
 
-	err = api.userService.Login(creds)
+	err = api.userService.Login(r.Context(), creds)
+	if errors.Is(err, service.ErrAccountDisabled) {
+		api.metrics.login(loginDisabled)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
+		return
+	}
+	if unavailable(w, err) {
+		return
+	}
 	if err != nil {
+		api.metrics.login(loginFailure)
+		retryAfter, _ := api.loginGuard.RecordFailure(r.Context(), creds.Username, ip)
+		if retryAfter > 0 {
+			tooManyAttempts(w, retryAfter)
+			return
+		}
+
 		w.WriteHeader(http.StatusUnauthorized)
 		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Wrong User or Password!"})
 		return
 	}
 
-	sessionToken := uuid.NewString()
-	expiresAt := time.Now().Add(5 * time.Hour)
-	session := model.Session{Token: sessionToken, Username: creds.Username, Expiry: expiresAt}
-
-	err = api.sessionService.SessionAvailName(session.Username)
+	twoFactor, err := api.twoFactorService.Enabled(r.Context(), creds.Username)
+	if unavailable(w, err) {
+		return
+	}
 	if err != nil {
-		err = api.sessionService.AddSession(session)
-	} else {
-		err = api.sessionService.UpdateSession(session)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+	if twoFactor {
+		challenge, err := api.twoFactorService.CreateChallenge(r.Context(), creds.Username)
+		if unavailable(w, err) {
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(challenge)
+		return
+	}
+
+	api.startSession(w, r, creds.Username, "Login Success")
+}
+
+// startSession creates a session for a user who has fully authenticated and
+// clears their failed login streak.
+func (api *API) startSession(w http.ResponseWriter, r *http.Request, username string, message string) {
+	api.metrics.login(loginSuccess)
+	api.loginGuard.RecordSuccess(r.Context(), username)
+	api.userService.RecordLogin(r.Context(), username)
+
+	session := model.Session{
+		Token:     uuid.NewString(),
+		Username:  username,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
 	}
 
+	session, err := api.sessionService.CreateSession(r.Context(), session)
+	if unavailable(w, err) {
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:    "session_token",
-		Path:    "/",
-		Value:   sessionToken,
-		Expires: expiresAt,
-	})
-
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(model.SuccessResponse{Message: "Login Success"})
+	api.writeSession(w, r, session, message)
 }
 
 func (api *API) Logout(w http.ResponseWriter, r *http.Request) {
-	c, err := r.Cookie("session_token")
+	token, _, err := sessionToken(r)
 	if err != nil {
-		if err == http.ErrNoCookie {
-			w.WriteHeader(http.StatusUnauthorized)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	if api.tokenService != nil {
+		caller := principal(r)
+		err := api.tokenService.RevokeSession(r.Context(), caller.SessionID)
+		if err == nil {
+			err = api.sessionService.RevokeSession(r.Context(), caller.Username, caller.SessionID)
+		}
+		// The session may already be gone, e.g. reaped or revoked elsewhere.
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = nil
+		}
+		if unavailable(w, err) {
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+			return
+		}
+	} else {
+		err := api.sessionService.DeleteSession(r.Context(), token)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = nil
+		}
+		if unavailable(w, err) {
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
 			json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
 			return
 		}
+	}
+
+	api.clearSessionCookie(w)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(model.SuccessResponse{Message: "Logout Success"})
+}
+
+// Refresh rotates the session token. It is authenticated by the session
+// token itself rather than by Auth, because in JWT mode the access token has
+// usually expired by the time a client needs to refresh.
+func (api *API) Refresh(w http.ResponseWriter, r *http.Request) {
+	token, fromCookie, err := api.refreshToken(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	session, err := api.sessionService.RotateSession(r.Context(), token)
+	if unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	if api.tokenService == nil && !fromCookie {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(model.TokenResponse{Username: session.Username, Token: session.Token, Expiry: session.Expiry})
+		return
+	}
+
+	api.writeSession(w, r, session, "Session Refreshed")
+}
+
+func (api *API) refreshToken(r *http.Request) (token string, fromCookie bool, err error) {
+	if api.tokenService != nil {
+		if c, err := r.Cookie("refresh_token"); err == nil {
+			return c.Value, true, nil
+		}
+		token, _, err := sessionToken(r)
+		return token, false, err
+	}
+	return sessionToken(r)
+}
+
+func (api *API) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+
+	err := api.loginGuard.Unlock(r.Context(), username)
+	if unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(model.SuccessResponse{Username: username, Message: "User Unlocked"})
+}
+
+func (api *API) ListUsers(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryInt(r, "limit", 50)
+	if err != nil || limit <= 0 || limit > 200 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "limit must be between 1 and 200"})
+		return
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil || offset < 0 {
 		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "offset must not be negative"})
+		return
+	}
+
+	users, err := api.userService.ListUsers(r.Context(), limit, offset)
+	if denied(w, err) || unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
 		return
 	}
-	sessionToken := c.Value
 
-	api.sessionService.DeleteSession(sessionToken)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(users)
+}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:    "session_token",
-		Value:   "",
-		Expires: time.Now(),
+// DisableUser blocks logins for the user and signs them out everywhere,
+// including their API keys. An admin cannot disable themselves.
+func (api *API) DisableUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+
+	err := api.transactor.Transaction(r.Context(), func(ctx context.Context) error {
+		if err := api.userService.SetDisabled(ctx, username, true); err != nil {
+			return err
+		}
+		if err := api.revokeAllSessions(ctx, username); err != nil {
+			return err
+		}
+		return api.apiKeyService.RevokeAll(ctx, username)
 	})
+	if errors.Is(err, service.ErrDisableSelf) {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: err.Error()})
+		return
+	}
+	if denied(w, err) {
+		return
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "User not found"})
+		return
+	}
+	if unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(model.SuccessResponse{Message: "Logout Success"})
+	json.NewEncoder(w).Encode(model.SuccessResponse{Username: username, Message: "User Disabled"})
+}
+
+func (api *API) EnableUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+
+	err := api.userService.SetDisabled(r.Context(), username, false)
+	if denied(w, err) {
+		return
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "User not found"})
+		return
+	}
+	if unavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(model.ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(model.SuccessResponse{Username: username, Message: "User Enabled"})
+}
+
+func tooManyAttempts(w http.ResponseWriter, retryAfter time.Duration) {
+	retryLater(w, retryAfter, "Too many failed login attempts, please try again later")
+}
+
+func retryLater(w http.ResponseWriter, retryAfter time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(model.ErrorResponse{Error: message})
 }
@@ -0,0 +1,28 @@
+package db
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// registerCallbacks hooks before and after around every kind of statement
+// gorm runs, under names prefixed with plugin. Both are given the
+// operation ("create", "query", ...) they are registered for.
+func registerCallbacks(conn *gorm.DB, plugin string, before, after func(operation string) func(*gorm.DB)) error {
+	callbacks := conn.Callback()
+	return errors.Join(
+		callbacks.Create().Before("gorm:create").Register(plugin+":before_create", before("create")),
+		callbacks.Create().After("gorm:create").Register(plugin+":after_create", after("create")),
+		callbacks.Query().Before("gorm:query").Register(plugin+":before_query", before("query")),
+		callbacks.Query().After("gorm:query").Register(plugin+":after_query", after("query")),
+		callbacks.Update().Before("gorm:update").Register(plugin+":before_update", before("update")),
+		callbacks.Update().After("gorm:update").Register(plugin+":after_update", after("update")),
+		callbacks.Delete().Before("gorm:delete").Register(plugin+":before_delete", before("delete")),
+		callbacks.Delete().After("gorm:delete").Register(plugin+":after_delete", after("delete")),
+		callbacks.Row().Before("gorm:row").Register(plugin+":before_row", before("row")),
+		callbacks.Row().After("gorm:row").Register(plugin+":after_row", after("row")),
+		callbacks.Raw().Before("gorm:raw").Register(plugin+":before_raw", before("raw")),
+		callbacks.Raw().After("gorm:raw").Register(plugin+":after_raw", after("raw")),
+	)
+}
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/utils"
+)
+
+// slowQuery is how long a query may take before it is logged as slow.
+const slowQuery = 200 * time.Millisecond
+
+// gormLogger sends GORM's failed and slow queries to the request logger in
+// the query's context, so they carry the request ID. The SQL itself is left
+// out since its arguments may hold passwords and tokens; the calling
+// repository line identifies the query instead.
+type gormLogger struct {
+	level logger.LogLevel
+}
+
+func (l gormLogger) LogMode(level logger.LogLevel) logger.Interface {
+	l.level = level
+	return l
+}
+
+func (l gormLogger) Info(ctx context.Context, msg string, data ...interface{}) {
+	if l.level >= logger.Info {
+		model.LoggerFrom(ctx).InfoContext(ctx, fmt.Sprintf(msg, data...))
+	}
+}
+
+func (l gormLogger) Warn(ctx context.Context, msg string, data ...interface{}) {
+	if l.level >= logger.Warn {
+		model.LoggerFrom(ctx).WarnContext(ctx, fmt.Sprintf(msg, data...))
+	}
+}
+
+func (l gormLogger) Error(ctx context.Context, msg string, data ...interface{}) {
+	if l.level >= logger.Error {
+		model.LoggerFrom(ctx).ErrorContext(ctx, fmt.Sprintf(msg, data...))
+	}
+}
+
+func (l gormLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	elapsed := time.Since(begin)
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound) && l.level >= logger.Error:
+		_, rows := fc()
+		model.LoggerFrom(ctx).ErrorContext(ctx, "query failed",
+			"caller", utils.FileWithLineNum(), "rows", rows, "elapsed_ms", elapsed.Milliseconds(), "err", err)
+	case elapsed > slowQuery && l.level >= logger.Warn:
+		_, rows := fc()
+		model.LoggerFrom(ctx).WarnContext(ctx, "slow query",
+			"caller", utils.FileWithLineNum(), "rows", rows, "elapsed_ms", elapsed.Milliseconds())
+	}
+}
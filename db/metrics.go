@@ -0,0 +1,50 @@
+package db
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"gorm.io/gorm"
+)
+
+const metricsStartKey = "metrics:start"
+
+// RegisterMetrics times every query run through conn and exposes the
+// connection pool statistics of its database handle on registerer.
+func (p *Postgres) RegisterMetrics(conn *gorm.DB, registerer prometheus.Registerer) error {
+	sqlDB, err := conn.DB()
+	if err != nil {
+		return err
+	}
+
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "Duration of database queries by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "table"})
+
+	if err := registerer.Register(duration); err != nil {
+		return err
+	}
+	if err := registerer.Register(collectors.NewDBStatsCollector(sqlDB, "postgres")); err != nil {
+		return err
+	}
+
+	start := func(string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			tx.InstanceSet(metricsStartKey, time.Now())
+		}
+	}
+	observe := func(operation string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			began, ok := tx.InstanceGet(metricsStartKey)
+			if !ok {
+				return
+			}
+			duration.WithLabelValues(operation, tx.Statement.Table).Observe(time.Since(began.(time.Time)).Seconds())
+		}
+	}
+
+	return registerCallbacks(conn, "metrics", start, observe)
+}
@@ -5,6 +5,7 @@ import (
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 
 	"a21hc3NpZ25tZW50/model"
 )
@@ -39,11 +40,15 @@ func (p *Postgres) Connect(creds *model.Credential) (*gorm.DB, error) {
 
 	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s TimeZone=Asia/Jakarta", Host, Username, Password, DatabaseName, Port)
 
-	dbConn, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	dbConn, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: gormLogger{level: logger.Warn}})
 	if err != nil {
 		return nil, err
 	}
 
+	if err := dbConn.Use(tracingPlugin{}); err != nil {
+		return nil, err
+	}
+
 	return dbConn, nil
 }
 
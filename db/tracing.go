@@ -0,0 +1,62 @@
+package db
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const (
+	tracerName     = "a21hc3NpZ25tZW50/db"
+	tracingSpanKey = "tracing:span"
+)
+
+// tracingPlugin runs every statement in a client span, a child of the span
+// in the statement's context. The span carries the SQL with its
+// placeholders but never the bound values.
+type tracingPlugin struct{}
+
+func (tracingPlugin) Name() string {
+	return "tracing"
+}
+
+func (tracingPlugin) Initialize(conn *gorm.DB) error {
+	start := func(operation string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			_, span := otel.Tracer(tracerName).Start(tx.Statement.Context, operation, trace.WithSpanKind(trace.SpanKindClient))
+			tx.InstanceSet(tracingSpanKey, span)
+		}
+	}
+	end := func(operation string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			value, ok := tx.InstanceGet(tracingSpanKey)
+			if !ok {
+				return
+			}
+			span := value.(trace.Span)
+			defer span.End()
+
+			table := tx.Statement.Table
+			if table != "" {
+				span.SetName(operation + " " + table)
+			}
+			span.SetAttributes(
+				attribute.String("db.system", "postgresql"),
+				attribute.String("db.operation", operation),
+				attribute.String("db.sql.table", table),
+				attribute.String("db.statement", tx.Statement.SQL.String()),
+				attribute.Int64("db.rows_affected", tx.Statement.RowsAffected),
+			)
+			if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+				span.RecordError(tx.Error)
+				span.SetStatus(codes.Error, tx.Error.Error())
+			}
+		}
+	}
+
+	return registerCallbacks(conn, "tracing", start, end)
+}
@@ -3,17 +3,45 @@ package main
 import (
 	"a21hc3NpZ25tZW50/api"
 	"a21hc3NpZ25tZW50/db"
+	"a21hc3NpZ25tZW50/helper"
 	"a21hc3NpZ25tZW50/model"
 	repo "a21hc3NpZ25tZW50/repository"
 	"a21hc3NpZ25tZW50/service"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 func main() {
 	godotenv.Load(".env")
 
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel(helper.EnvString("LOG_LEVEL", "info"))}))
+	slog.SetDefault(logger)
+
+	tracerProvider, err := newTracerProvider(helper.EnvString("TRACING_EXPORTER", "none"))
+	if err != nil {
+		panic(err)
+	}
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
 	db := db.NewDB()
 	dbCredential := model.Credential{
 		Host:                    "localhost",
@@ -34,7 +62,71 @@ func main() {
 		panic(err)
 	}
 
-	conn.AutoMigrate(&model.User{}, &model.Session{}, &model.Student{}, &model.Class{})
+	registry := prometheus.NewRegistry()
+	if err := db.RegisterMetrics(conn, registry); err != nil {
+		panic(err)
+	}
+
+	models := []any{&model.User{}, &model.Session{}, &model.Student{}, &model.Class{}, &model.APIKey{}, &model.RevokedToken{}, &model.LoginAttempt{}, &model.PasswordResetToken{}, &model.TwoFactor{}, &model.RecoveryCode{}, &model.LoginChallenge{}, &model.RoleSetting{}, &model.AuditEvent{}}
+	// API key prefixes used to be unique across soft-deleted rows as well;
+	// the live-only index below replaces that one.
+	if conn.Migrator().HasIndex(&model.APIKey{}, "idx_api_keys_prefix") {
+		if err := conn.Migrator().DropIndex(&model.APIKey{}, "idx_api_keys_prefix"); err != nil {
+			panic(err)
+		}
+	}
+	if err := conn.AutoMigrate(models...); err != nil {
+		panic(err)
+	}
+
+	userRepo := repo.NewUserRepo(conn)
+	sessionRepo := repo.NewSessionRepo(conn)
+	sessionMaxLifetime := helper.EnvDuration("SESSION_MAX_LIFETIME", 7*24*time.Hour)
+	reaperConfig := model.ReaperConfig{
+		Interval:    helper.EnvDuration("SESSION_REAP_INTERVAL", 10*time.Minute),
+		BatchSize:   helper.EnvInt("SESSION_REAP_BATCH_SIZE", 500),
+		MaxLifetime: sessionMaxLifetime,
+		Logger:      logger,
+	}
+	sessionReaper := service.NewSessionReaper(sessionRepo, reaperConfig)
+	passwordPolicy := service.NewPasswordPolicy(model.PasswordPolicyConfig{
+		MinLength:        helper.EnvInt("PASSWORD_MIN_LENGTH", 8),
+		MinCharClasses:   helper.EnvInt("PASSWORD_MIN_CHAR_CLASSES", 2),
+		Blocklist:        passwordBlocklist(os.Getenv("PASSWORD_BLOCKLIST_FILE")),
+		DisallowUsername: helper.EnvBool("PASSWORD_DISALLOW_USERNAME", true),
+	})
+	passwordResetRepo := repo.NewPasswordResetRepo(conn)
+	auditService := service.NewAuditService(repo.NewAuditRepo(conn))
+	transactor := repo.NewTransactor(conn)
+	userService := service.NewUserService(userRepo, passwordResetRepo, passwordPolicy, newNotifier(os.Getenv("NOTIFIER_FILE"), logger), auditService, transactor, model.PasswordResetConfig{
+		TokenTTL: helper.EnvDuration("PASSWORD_RESET_TTL", 30*time.Minute),
+	})
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "reap-sessions":
+			stats, err := sessionReaper.RunOnce(context.Background())
+			json.NewEncoder(os.Stdout).Encode(stats)
+			if err != nil {
+				os.Exit(1)
+			}
+			return
+		case "promote-admin":
+			if len(os.Args) < 3 {
+				fmt.Println("usage: promote-admin <username>")
+				os.Exit(2)
+			}
+			if err := userService.SetRole(context.Background(), os.Args[2], model.RoleAdmin); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			fmt.Printf("%s is now an admin\n", os.Args[2])
+			return
+		default:
+			fmt.Printf("unknown command %q\n", os.Args[1])
+			os.Exit(2)
+		}
+	}
 
 	classes := []model.Class{
 		{
@@ -54,22 +146,219 @@ func main() {
 		},
 	}
 
+	classNames := []string{}
 	for _, c := range classes {
 		if err := conn.Create(&c).Error; err != nil {
 			panic("failed to create default classes")
 		}
+		classNames = append(classNames, c.Name)
 	}
 
-	userRepo := repo.NewUserRepo(conn)
-	sessionRepo := repo.NewSessionRepo(conn)
+	healthService := service.NewHealthService(repo.NewHealthRepo(conn), model.HealthConfig{
+		Timeout: helper.EnvDuration("READY_TIMEOUT", 2*time.Second),
+		Models:  models,
+		Classes: classNames,
+	})
+
 	studentRepo := repo.NewStudentRepo(conn)
 	classRepo := repo.NewClassRepo(conn)
+	apiKeyRepo := repo.NewAPIKeyRepo(conn)
+	revokedTokenRepo := repo.NewRevokedTokenRepo(conn)
+	loginAttemptRepo := repo.NewLoginAttemptRepo(conn)
+	twoFactorRepo := repo.NewTwoFactorRepo(conn)
+	roleSettingRepo := repo.NewRoleSettingRepo(conn)
 
-	userService := service.NewUserService(userRepo)
-	sessionService := service.NewSessionService(sessionRepo)
-	studentService := service.NewStudentService(studentRepo)
+	sessionConfig := model.SessionConfig{
+		MaxActive:       helper.EnvInt("SESSION_MAX_ACTIVE", 5),
+		IdleTimeout:     helper.EnvDuration("SESSION_IDLE_TIMEOUT", 5*time.Hour),
+		MaxLifetime:     sessionMaxLifetime,
+		RefreshThrottle: helper.EnvDuration("SESSION_REFRESH_THROTTLE", 5*time.Minute),
+	}
+
+	sessionService := service.NewSessionService(sessionRepo, sessionConfig)
+	studentService := service.NewStudentService(studentRepo, auditService, transactor, model.StudentConfig{
+		TrashRetention: helper.EnvDuration("STUDENT_TRASH_RETENTION", 30*24*time.Hour),
+	})
 	classService := service.NewClassService(classRepo)
+	apiKeyService := service.NewAPIKeyService(apiKeyRepo)
+	loginGuard := service.NewLoginGuard(loginAttemptRepo, model.LockoutConfig{
+		UserThreshold: helper.EnvInt("LOGIN_USER_THRESHOLD", 5),
+		IPThreshold:   helper.EnvInt("LOGIN_IP_THRESHOLD", 20),
+		Window:        helper.EnvDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+		BaseDelay:     helper.EnvDuration("LOGIN_LOCKOUT_BASE", 30*time.Second),
+		MaxDelay:      helper.EnvDuration("LOGIN_LOCKOUT_MAX", time.Hour),
+	})
+	resetGuard := service.NewResetGuard(loginAttemptRepo, model.LockoutConfig{
+		KindPrefix:    "password_reset_",
+		UserThreshold: helper.EnvInt("PASSWORD_RESET_USER_THRESHOLD", 3),
+		IPThreshold:   helper.EnvInt("PASSWORD_RESET_IP_THRESHOLD", 10),
+		Window:        helper.EnvDuration("PASSWORD_RESET_WINDOW", time.Hour),
+		BaseDelay:     helper.EnvDuration("PASSWORD_RESET_LOCKOUT_BASE", 15*time.Minute),
+		MaxDelay:      helper.EnvDuration("PASSWORD_RESET_LOCKOUT_MAX", 24*time.Hour),
+	})
+	twoFactorService := service.NewTwoFactorService(twoFactorRepo, roleSettingRepo, model.TwoFactorConfig{
+		Issuer:       helper.EnvString("TOTP_ISSUER", "student-portal"),
+		ChallengeTTL: helper.EnvDuration("TWO_FACTOR_CHALLENGE_TTL", 5*time.Minute),
+		MaxAttempts:  helper.EnvInt("TWO_FACTOR_MAX_ATTEMPTS", 5),
+	})
+
+	var tokenService service.TokenService
+	if helper.EnvString("SESSION_MODE", model.SessionModeOpaque) == model.SessionModeJWT {
+		keys, err := parseJWTKeys(os.Getenv("JWT_KEYS"))
+		if err != nil {
+			panic(err)
+		}
+
+		tokenService, err = service.NewTokenService(revokedTokenRepo, model.JWTConfig{
+			Algorithm:   helper.EnvString("JWT_ALGORITHM", service.AlgorithmHS256),
+			Keys:        keys,
+			ActiveKeyID: os.Getenv("JWT_ACTIVE_KID"),
+			AccessTTL:   helper.EnvDuration("JWT_ACCESS_TTL", 15*time.Minute),
+			Issuer:      helper.EnvString("JWT_ISSUER", "student-portal"),
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// CSRF tokens are signed with this secret; a per-process key would void
+	// them on every restart and on every other instance.
+	csrfSecret := os.Getenv("CSRF_SECRET")
+	if csrfSecret == "" {
+		panic("CSRF_SECRET must be set")
+	}
+
+	apiConfig := model.APIConfig{
+		Cookie: model.CookieConfig{
+			Path:     "/",
+			Domain:   os.Getenv("COOKIE_DOMAIN"),
+			Secure:   helper.EnvBool("COOKIE_SECURE", true),
+			HttpOnly: helper.EnvBool("COOKIE_HTTP_ONLY", true),
+			SameSite: helper.EnvString("COOKIE_SAME_SITE", "lax"),
+		},
+		CSRFSecret:     csrfSecret,
+		Logger:         logger,
+		Metrics:        registry,
+		DrainDelay:     helper.EnvDuration("SHUTDOWN_DRAIN_DELAY", 0),
+		RequestTimeout: helper.EnvDuration("REQUEST_TIMEOUT", 10*time.Second),
+	}
+
+	mainAPI := api.NewAPI(api.Services{
+		User:          userService,
+		Session:       sessionService,
+		Student:       studentService,
+		Class:         classService,
+		APIKey:        apiKeyService,
+		Token:         tokenService,
+		LoginGuard:    loginGuard,
+		ResetGuard:    resetGuard,
+		TwoFactor:     twoFactorService,
+		Audit:         auditService,
+		Health:        healthService,
+		SessionReaper: sessionReaper,
+		Transactor:    transactor,
+	}, apiConfig)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	sessionReaper.Start()
+	go mainAPI.Start()
+
+	<-ctx.Done()
+	logger.Info("shutting down web server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), apiConfig.DrainDelay+10*time.Second)
+	defer cancel()
+
+	if err := mainAPI.Shutdown(shutdownCtx); err != nil {
+		logger.Error("shutdown failed", "err", err)
+	}
+	sessionReaper.Stop()
+	if err := tracerProvider.Shutdown(shutdownCtx); err != nil {
+		logger.Error("flushing traces failed", "err", err)
+	}
+}
+
+// parseJWTKeys reads JWT_KEYS, a comma separated list of "kid:base64key"
+// pairs. Keeping retired keys in the list lets their tokens verify until they
+// expire.
+func parseJWTKeys(value string) (map[string][]byte, error) {
+	keys := map[string][]byte{}
+	for _, pair := range strings.Split(value, ",") {
+		kid, encoded, found := strings.Cut(strings.TrimSpace(pair), ":")
+		if !found || kid == "" {
+			return nil, fmt.Errorf("invalid JWT_KEYS entry %q, expected kid:base64key", pair)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWT key %q: %w", kid, err)
+		}
+		keys[kid] = key
+	}
+	return keys, nil
+}
+
+// passwordBlocklist reads extra forbidden passwords, one per line, on top of
+// the built-in list of common passwords.
+func passwordBlocklist(path string) []string {
+	if path == "" {
+		return nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+	return strings.Split(string(content), "\n")
+}
+
+// newNotifier appends notifications to path as JSON lines. Without a path
+// nothing is delivered; reset tokens are never printed.
+func newNotifier(path string, logger *slog.Logger) service.Notifier {
+	if path == "" {
+		logger.Warn("NOTIFIER_FILE is not set; password reset tokens will not be delivered")
+		return service.NewDiscardNotifier(logger)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		panic(err)
+	}
+	return service.NewWriterNotifier(f)
+}
+
+// logLevel parses LOG_LEVEL, one of debug, info, warn or error.
+func logLevel(value string) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		panic(fmt.Errorf("invalid LOG_LEVEL %q: %w", value, err))
+	}
+	return level
+}
+
+// newTracerProvider exports spans to stdout or to the OTLP/HTTP collector
+// configured by the standard OTEL_EXPORTER_OTLP_* variables. With "none" the
+// spans are still created, so trace IDs are logged, but dropped.
+func newTracerProvider(exporter string) (*sdktrace.TracerProvider, error) {
+	res := resource.NewSchemaless(attribute.String("service.name", helper.EnvString("OTEL_SERVICE_NAME", "student-portal")))
+
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "none":
+		return sdktrace.NewTracerProvider(sdktrace.WithResource(res)), nil
+	case "stdout":
+		spanExporter, err = stdouttrace.New()
+	case "otlp":
+		spanExporter, err = otlptracehttp.New(context.Background())
+	default:
+		return nil, fmt.Errorf("invalid TRACING_EXPORTER %q, expected none, stdout or otlp", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	mainAPI := api.NewAPI(userService, sessionService, studentService, classService)
-	mainAPI.Start()
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(spanExporter), sdktrace.WithResource(res)), nil
 }
@@ -1,6 +1,10 @@
 package main_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -12,6 +16,10 @@ import (
 	"github.com/farismnrr/golang-authorization-api/test"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"gorm.io/gorm"
 )
 
 var _ = Describe("Education Management", func() {
@@ -20,6 +28,13 @@ var _ = Describe("Education Management", func() {
 	var userRepo repo.UserRepository
 	var sessionRepo repo.SessionsRepository
 	var classRepo repo.ClassRepository
+	var apiKeyRepo repo.APIKeyRepository
+	var loginAttemptRepo repo.LoginAttemptRepository
+	var passwordResetRepo repo.PasswordResetRepository
+	var twoFactorRepo repo.TwoFactorRepository
+	var roleSettingRepo repo.RoleSettingRepository
+	var auditRepo repo.AuditRepository
+	var transactor repo.Transactor
 
 	var sessionService service.SessionService
 
@@ -39,14 +54,25 @@ var _ = Describe("Education Management", func() {
 	userRepo = repo.NewUserRepo(conn)
 	sessionRepo = repo.NewSessionRepo(conn)
 	classRepo = repo.NewClassRepo(conn)
+	apiKeyRepo = repo.NewAPIKeyRepo(conn)
+	loginAttemptRepo = repo.NewLoginAttemptRepo(conn)
+	passwordResetRepo = repo.NewPasswordResetRepo(conn)
+	twoFactorRepo = repo.NewTwoFactorRepo(conn)
+	roleSettingRepo = repo.NewRoleSettingRepo(conn)
+	auditRepo = repo.NewAuditRepo(conn)
+	transactor = repo.NewTransactor(conn)
 
-	sessionService = service.NewSessionService(sessionRepo)
+	sessionService = service.NewSessionService(sessionRepo, model.SessionConfig{})
+
+	ctx := context.Background()
+	aditira := model.WithPrincipal(context.Background(), model.Principal{Username: "aditira", Roles: []string{model.RoleUser}, Method: model.AuthMethodSession})
+	admin := model.WithPrincipal(context.Background(), model.Principal{Username: "admin", Roles: []string{model.RoleAdmin}, Method: model.AuthMethodSession})
 
 	BeforeEach(func() {
-		err = conn.Migrator().DropTable("students", "users", "sessions", "classes")
+		err = conn.Migrator().DropTable("students", "users", "sessions", "classes", "api_keys", "login_attempts", "password_reset_tokens", "two_factors", "recovery_codes", "login_challenges", "role_settings", "audit_events")
 		Expect(err).ShouldNot(HaveOccurred())
 
-		conn.AutoMigrate(&model.User{}, &model.Session{}, &model.Student{}, &model.Class{})
+		conn.AutoMigrate(&model.User{}, &model.Session{}, &model.Student{}, &model.Class{}, &model.APIKey{}, &model.LoginAttempt{}, &model.PasswordResetToken{}, &model.TwoFactor{}, &model.RecoveryCode{}, &model.LoginChallenge{}, &model.RoleSetting{}, &model.AuditEvent{})
 
 		err = db.Reset(conn, "students")
 		err = db.Reset(conn, "users")
@@ -65,7 +91,7 @@ var _ = Describe("Education Management", func() {
 							Username: "aditira",
 							Password: "!opensesame",
 						}
-						err := userRepo.Add(user)
+						err := userRepo.Add(ctx, user)
 						Expect(err).ShouldNot(HaveOccurred())
 
 						result := model.User{}
@@ -81,7 +107,7 @@ var _ = Describe("Education Management", func() {
 				When("check user availability in users table database postgres", func() {
 					It("return error if present and nil if not present", func() {
 						user := model.User{}
-						err := userRepo.CheckAvail(user)
+						err := userRepo.CheckAvail(ctx, user)
 						Expect(err).Should(HaveOccurred())
 
 						user = model.User{
@@ -89,7 +115,7 @@ var _ = Describe("Education Management", func() {
 							Password: "!opensesame",
 						}
 
-						err = userRepo.Add(user)
+						err = userRepo.Add(ctx, user)
 						Expect(err).ShouldNot(HaveOccurred())
 
 						result := model.User{}
@@ -97,7 +123,7 @@ var _ = Describe("Education Management", func() {
 						Expect(result.Username).To(Equal(user.Username))
 						Expect(result.Password).To(Equal(user.Password))
 
-						err = userRepo.CheckAvail(user)
+						err = userRepo.CheckAvail(ctx, user)
 						Expect(err).ShouldNot(HaveOccurred())
 
 						err = db.Reset(conn, "users")
@@ -114,7 +140,7 @@ var _ = Describe("Education Management", func() {
 							Username: "aditira",
 							Expiry:   time.Date(2022, 11, 17, 20, 34, 58, 651387237, time.UTC),
 						}
-						err := sessionRepo.AddSessions(session)
+						err := sessionRepo.AddSessions(ctx, session)
 						Expect(err).ShouldNot(HaveOccurred())
 
 						result := model.Session{}
@@ -134,7 +160,7 @@ var _ = Describe("Education Management", func() {
 							Username: "aditira",
 							Expiry:   time.Date(2022, 11, 17, 20, 34, 58, 651387237, time.UTC),
 						}
-						err := sessionRepo.AddSessions(session)
+						err := sessionRepo.AddSessions(ctx, session)
 						Expect(err).ShouldNot(HaveOccurred())
 
 						result := model.Session{}
@@ -143,7 +169,7 @@ var _ = Describe("Education Management", func() {
 						Expect(result.Token).To(Equal(session.Token))
 						Expect(result.Username).To(Equal(session.Username))
 
-						err = sessionRepo.DeleteSession("cc03dbea-4085-47ba-86fe-020f5d01a9d8")
+						err = sessionRepo.DeleteSession(ctx, "cc03dbea-4085-47ba-86fe-020f5d01a9d8")
 						Expect(err).ShouldNot(HaveOccurred())
 
 						result = model.Session{}
@@ -162,7 +188,7 @@ var _ = Describe("Education Management", func() {
 							Username: "aditira",
 							Expiry:   time.Date(2022, 11, 17, 20, 34, 58, 651387237, time.UTC),
 						}
-						err := sessionRepo.AddSessions(session)
+						err := sessionRepo.AddSessions(ctx, session)
 						Expect(err).ShouldNot(HaveOccurred())
 
 						result := model.Session{}
@@ -175,7 +201,7 @@ var _ = Describe("Education Management", func() {
 							Username: "aditira",
 							Expiry:   time.Date(2022, 11, 17, 20, 34, 58, 651387237, time.UTC),
 						}
-						err = sessionRepo.UpdateSessions(sessionUpdate)
+						err = sessionRepo.UpdateSessions(ctx, sessionUpdate)
 						Expect(err).ShouldNot(HaveOccurred())
 
 						result = model.Session{}
@@ -194,7 +220,7 @@ var _ = Describe("Education Management", func() {
 							Username: "aditira",
 							Expiry:   time.Now().Add(5 * time.Hour),
 						}
-						err := sessionRepo.AddSessions(session)
+						err := sessionRepo.AddSessions(ctx, session)
 						Expect(err).ShouldNot(HaveOccurred())
 
 						result := model.Session{}
@@ -202,7 +228,7 @@ var _ = Describe("Education Management", func() {
 						Expect(result.Token).To(Equal(session.Token))
 						Expect(result.Username).To(Equal(session.Username))
 
-						tokenFound, err := sessionService.TokenValidity("cc03dbea-4085-47ba-86fe-020f5d01a9d8")
+						tokenFound, err := sessionService.TokenValidity(ctx, "cc03dbea-4085-47ba-86fe-020f5d01a9d8")
 						Expect(err).ShouldNot(HaveOccurred())
 						Expect(tokenFound.Token).To(Equal("cc03dbea-4085-47ba-86fe-020f5d01a9d8"))
 						Expect(tokenFound.Username).To(Equal("aditira"))
@@ -219,7 +245,7 @@ var _ = Describe("Education Management", func() {
 							Username: "aditira",
 							Expiry:   time.Now().Add(-25 * time.Hour),
 						}
-						err := sessionRepo.AddSessions(session)
+						err := sessionRepo.AddSessions(ctx, session)
 						Expect(err).ShouldNot(HaveOccurred())
 
 						result := model.Session{}
@@ -227,7 +253,7 @@ var _ = Describe("Education Management", func() {
 						Expect(result.Token).To(Equal(session.Token))
 						Expect(result.Username).To(Equal(session.Username))
 
-						tokenFound, err := sessionService.TokenValidity("cc03dbea-4085-47ba-86fe-020f5d01a9d8")
+						tokenFound, err := sessionService.TokenValidity(ctx, "cc03dbea-4085-47ba-86fe-020f5d01a9d8")
 						Expect(err).To(Equal(fmt.Errorf("Token is Expired!")))
 						Expect(tokenFound).To(Equal(model.Session{}))
 
@@ -238,7 +264,7 @@ var _ = Describe("Education Management", func() {
 
 				When("check session availability with name", func() {
 					It("return data session with target name", func() {
-						err := sessionRepo.SessionAvailName("aditira")
+						err := sessionRepo.SessionAvailName(ctx, "aditira")
 						Expect(err).Should(HaveOccurred())
 
 						session := model.Session{
@@ -246,7 +272,7 @@ var _ = Describe("Education Management", func() {
 							Username: "aditira",
 							Expiry:   time.Now().Add(5 * time.Hour),
 						}
-						err = sessionRepo.AddSessions(session)
+						err = sessionRepo.AddSessions(ctx, session)
 						Expect(err).ShouldNot(HaveOccurred())
 
 						result := model.Session{}
@@ -254,7 +280,85 @@ var _ = Describe("Education Management", func() {
 						Expect(result.Token).To(Equal(session.Token))
 						Expect(result.Username).To(Equal(session.Username))
 
-						err = sessionRepo.SessionAvailName("aditira")
+						err = sessionRepo.SessionAvailName(ctx, "aditira")
+						Expect(err).ShouldNot(HaveOccurred())
+
+						err = db.Reset(conn, "sessions")
+						Expect(err).ShouldNot(HaveOccurred())
+					})
+				})
+
+				When("a user logs in from several devices", func() {
+					It("should keep every session and revoke the oldest beyond the configured maximum", func() {
+						limitedService := service.NewSessionService(sessionRepo, model.SessionConfig{MaxActive: 2})
+						tokens := []string{
+							"cc03dbea-4085-47ba-86fe-020f5d01a9d8",
+							"cc03dbac-4085-22ba-75fe-103f9a01b6d5",
+							"0f5a8e2c-7d3b-4a57-9a1e-6b2f1c9d4e07",
+						}
+
+						for _, token := range tokens {
+							_, err := limitedService.CreateSession(ctx, model.Session{
+								Token:    token,
+								Username: "aditira",
+								Expiry:   time.Now().Add(5 * time.Hour),
+							})
+							Expect(err).ShouldNot(HaveOccurred())
+						}
+
+						sessions, err := limitedService.ListSessions(ctx, "aditira")
+						Expect(err).ShouldNot(HaveOccurred())
+						Expect(sessions).To(HaveLen(2))
+
+						_, err = sessionRepo.SessionAvailToken(ctx, tokens[0])
+						Expect(err).Should(HaveOccurred())
+
+						err = limitedService.RevokeSession(ctx, "aditira", sessions[0].ID)
+						Expect(err).ShouldNot(HaveOccurred())
+
+						err = limitedService.RevokeAllSessions(ctx, "aditira")
+						Expect(err).ShouldNot(HaveOccurred())
+
+						sessions, err = limitedService.ListSessions(ctx, "aditira")
+						Expect(err).ShouldNot(HaveOccurred())
+						Expect(sessions).To(BeEmpty())
+
+						err = db.Reset(conn, "sessions")
+						Expect(err).ShouldNot(HaveOccurred())
+					})
+				})
+
+				When("an active session is used", func() {
+					It("should slide the expiry forward and rotate the token without passing the absolute lifetime", func() {
+						slidingService := service.NewSessionService(sessionRepo, model.SessionConfig{
+							IdleTimeout: time.Hour,
+							MaxLifetime: 90 * time.Minute,
+						})
+
+						session, err := slidingService.CreateSession(ctx, model.Session{
+							Token:    "cc03dbea-4085-47ba-86fe-020f5d01a9d8",
+							Username: "aditira",
+							Expiry:   time.Now().Add(10 * time.Minute),
+						})
+						Expect(err).ShouldNot(HaveOccurred())
+
+						session, err = slidingService.TokenValidity(ctx, session.Token)
+						Expect(err).ShouldNot(HaveOccurred())
+
+						extended, ok, err := slidingService.ExtendSession(ctx, session)
+						Expect(err).ShouldNot(HaveOccurred())
+						Expect(ok).To(BeTrue())
+						Expect(extended.Expiry).To(BeTemporally("~", time.Now().Add(time.Hour), time.Minute))
+
+						rotated, err := slidingService.RotateSession(ctx, session.Token)
+						Expect(err).ShouldNot(HaveOccurred())
+						Expect(rotated.Token).NotTo(Equal(session.Token))
+						Expect(rotated.Expiry).To(BeTemporally("<=", session.CreatedAt.Add(90*time.Minute)))
+
+						_, err = slidingService.TokenValidity(ctx, session.Token)
+						Expect(err).Should(HaveOccurred())
+
+						_, err = slidingService.TokenValidity(ctx, rotated.Token)
 						Expect(err).ShouldNot(HaveOccurred())
 
 						err = db.Reset(conn, "sessions")
@@ -262,9 +366,42 @@ var _ = Describe("Education Management", func() {
 					})
 				})
 
+				When("reaping expired sessions", func() {
+					It("should permanently delete expired and revoked sessions in batches", func() {
+						sessions := []model.Session{
+							{Token: "cc03dbea-4085-47ba-86fe-020f5d01a9d8", Username: "aditira", Expiry: time.Now().Add(-25 * time.Hour)},
+							{Token: "cc03dbac-4085-22ba-75fe-103f9a01b6d5", Username: "aditira", Expiry: time.Now().Add(-1 * time.Hour)},
+							{Token: "0f5a8e2c-7d3b-4a57-9a1e-6b2f1c9d4e07", Username: "aditira", Expiry: time.Now().Add(5 * time.Hour)},
+							{Token: "5b1d7c0e-2f4a-4c8e-8d6b-9a3e7f1c2b45", Username: "aditira", Expiry: time.Now().Add(5 * time.Hour)},
+						}
+						for _, session := range sessions {
+							err := sessionRepo.AddSessions(ctx, session)
+							Expect(err).ShouldNot(HaveOccurred())
+						}
+
+						err := sessionRepo.DeleteSession(ctx, "5b1d7c0e-2f4a-4c8e-8d6b-9a3e7f1c2b45")
+						Expect(err).ShouldNot(HaveOccurred())
+
+						reaper := service.NewSessionReaper(sessionRepo, model.ReaperConfig{BatchSize: 2})
+						stats, err := reaper.RunOnce(ctx)
+						Expect(err).ShouldNot(HaveOccurred())
+						Expect(stats.Deleted).To(Equal(int64(3)))
+						Expect(stats.Batches).To(Equal(2))
+						Expect(stats.Active).To(Equal(int64(1)))
+						Expect(reaper.Stats()).To(Equal(stats))
+
+						var remaining int64
+						conn.Unscoped().Model(&model.Session{}).Count(&remaining)
+						Expect(remaining).To(Equal(int64(1)))
+
+						err = db.Reset(conn, "sessions")
+						Expect(err).ShouldNot(HaveOccurred())
+					})
+				})
+
 				When("check session availability with token", func() {
 					It("return data session with target token", func() {
-						_, err := sessionRepo.SessionAvailToken("cc03dbea-4085-47ba-86fe-020f5d01a9d8")
+						_, err := sessionRepo.SessionAvailToken(ctx, "cc03dbea-4085-47ba-86fe-020f5d01a9d8")
 						Expect(err).Should(HaveOccurred())
 
 						session := model.Session{
@@ -272,7 +409,7 @@ var _ = Describe("Education Management", func() {
 							Username: "aditira",
 							Expiry:   time.Now().Add(5 * time.Hour),
 						}
-						err = sessionRepo.AddSessions(session)
+						err = sessionRepo.AddSessions(ctx, session)
 						Expect(err).ShouldNot(HaveOccurred())
 
 						result := model.Session{}
@@ -280,7 +417,7 @@ var _ = Describe("Education Management", func() {
 						Expect(result.Token).To(Equal(session.Token))
 						Expect(result.Username).To(Equal(session.Username))
 
-						res, err := sessionRepo.SessionAvailToken("cc03dbea-4085-47ba-86fe-020f5d01a9d8")
+						res, err := sessionRepo.SessionAvailToken(ctx, "cc03dbea-4085-47ba-86fe-020f5d01a9d8")
 						Expect(err).ShouldNot(HaveOccurred())
 						Expect(res.Token).To(Equal(session.Token))
 						Expect(res.Username).To(Equal(session.Username))
@@ -294,6 +431,360 @@ var _ = Describe("Education Management", func() {
 
 		})
 
+		Describe("API key repository", func() {
+			When("a user creates an API key", func() {
+				It("should store only its hash and authenticate the plaintext key", func() {
+					apiKeyService := service.NewAPIKeyService(apiKeyRepo)
+
+					created, err := apiKeyService.Create(aditira, model.APIKeyRequest{
+						Name:   "grading script",
+						Scopes: []string{model.ScopeStudentsRead},
+					})
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(created.Key).To(HavePrefix("sp_"))
+
+					result := model.APIKey{}
+					conn.Model(&model.APIKey{}).First(&result)
+					Expect(result.Hash).NotTo(BeEmpty())
+					Expect(result.Hash).NotTo(ContainSubstring(created.Key))
+					Expect(result.Scopes).To(Equal([]string{model.ScopeStudentsRead}))
+
+					apiKey, err := apiKeyService.Authenticate(ctx, created.Key)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(apiKey.Username).To(Equal("aditira"))
+					Expect(apiKey.LastUsedAt).NotTo(BeNil())
+
+					_, err = apiKeyService.Authenticate(ctx, created.Key + "0")
+					Expect(err).Should(HaveOccurred())
+
+					err = apiKeyService.Revoke(aditira, apiKey.ID)
+					Expect(err).ShouldNot(HaveOccurred())
+
+					_, err = apiKeyService.Authenticate(ctx, created.Key)
+					Expect(err).Should(HaveOccurred())
+				})
+
+				It("should reject scopes that cannot be granted to an API key", func() {
+					apiKeyService := service.NewAPIKeyService(apiKeyRepo)
+
+					_, err := apiKeyService.Create(aditira, model.APIKeyRequest{
+						Name:   "too powerful",
+						Scopes: []string{model.ScopeAccount},
+					})
+					Expect(err).Should(HaveOccurred())
+				})
+			})
+		})
+
+		Describe("User profile", func() {
+			When("a user manages their account", func() {
+				It("should update the profile, honour disabling and delete the account", func() {
+					userService := service.NewUserService(userRepo, passwordResetRepo,
+						service.NewPasswordPolicy(model.PasswordPolicyConfig{}), service.NewWriterNotifier(&bytes.Buffer{}), service.NewAuditService(auditRepo), transactor, model.PasswordResetConfig{})
+
+					err := userRepo.Add(ctx, model.User{Username: "aditira", Password: "!opensesame"})
+					Expect(err).ShouldNot(HaveOccurred())
+
+					name, email := "Aditira Jamhuri", "not an email"
+					_, err = userService.UpdateProfile(aditira, model.ProfileUpdate{DisplayName: &name, Email: &email})
+					Expect(err).To(MatchError(service.ErrInvalidProfile))
+
+					email = "aditira@example.com"
+					profile, err := userService.UpdateProfile(aditira, model.ProfileUpdate{DisplayName: &name, Email: &email})
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(profile.DisplayName).To(Equal(name))
+					Expect(profile.Email).To(Equal(email))
+
+					err = userService.RecordLogin(aditira, "aditira")
+					Expect(err).ShouldNot(HaveOccurred())
+					profile, err = userService.Profile(aditira)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(profile.LastLoginAt).NotTo(BeNil())
+
+					err = userService.SetDisabled(admin, "aditira", true)
+					Expect(err).ShouldNot(HaveOccurred())
+					err = userService.Login(ctx, model.User{Username: "aditira", Password: "!opensesame"})
+					Expect(err).To(MatchError(service.ErrAccountDisabled))
+
+					err = userService.SetDisabled(admin, "aditira", false)
+					Expect(err).ShouldNot(HaveOccurred())
+
+					err = userService.DeleteAccount(aditira, "wrong")
+					Expect(err).To(MatchError(service.ErrWrongPassword))
+					err = userService.DeleteAccount(aditira, "!opensesame")
+					Expect(err).ShouldNot(HaveOccurred())
+
+					users, err := userService.ListUsers(admin, 50, 0)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(users).To(BeEmpty())
+				})
+			})
+		})
+
+		Describe("Audit repository", func() {
+			When("a student is changed through the service", func() {
+				It("should record who changed which fields", func() {
+					auditService := service.NewAuditService(auditRepo)
+					studentService := service.NewStudentService(studentRepo, auditService, transactor, model.StudentConfig{})
+					ctx := model.WithRequestInfo(aditira, model.RequestInfo{ID: "req-1", IP: "192.0.2.1"})
+
+					student := model.Student{Name: "John", Address: "Jakarta", ClassId: 1}
+					err := studentService.Store(ctx, &student)
+					Expect(err).ShouldNot(HaveOccurred())
+					_, err = studentService.Update(ctx, int(student.ID), &model.Student{Address: "Bandung"}, student.Version)
+					Expect(err).ShouldNot(HaveOccurred())
+					err = studentService.Delete(ctx, int(student.ID))
+					Expect(err).ShouldNot(HaveOccurred())
+
+					_, err = auditService.List(aditira, model.AuditFilter{}, 50, 0)
+					Expect(err).To(MatchError(service.ErrForbidden))
+
+					events, err := auditService.List(admin, model.AuditFilter{Entity: model.AuditEntityStudent, EntityID: fmt.Sprint(student.ID)}, 50, 0)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(events).To(HaveLen(3))
+					Expect(events[0].Action).To(Equal(model.AuditActionDelete))
+					Expect(events[2].Action).To(Equal(model.AuditActionCreate))
+
+					update := events[1]
+					Expect(update.Actor).To(Equal("aditira"))
+					Expect(update.RequestID).To(Equal("req-1"))
+					Expect(update.IP).To(Equal("192.0.2.1"))
+					Expect(update.Before).To(HaveKeyWithValue("address", "Jakarta"))
+					Expect(update.After).To(HaveKeyWithValue("address", "Bandung"))
+					Expect(update.After).NotTo(HaveKey("name"))
+				})
+			})
+		})
+
+		Describe("Transactor", func() {
+			It("should roll back every repository call when the unit of work fails", func() {
+				err := transactor.Transaction(ctx, func(ctx context.Context) error {
+					if err := studentRepo.Store(ctx, &model.Student{Name: "John", Address: "Jakarta", ClassId: 1}); err != nil {
+						return err
+					}
+					if err := userRepo.Add(ctx, model.User{Username: "aditira", Password: "1234"}); err != nil {
+						return err
+					}
+					return errors.New("move failed")
+				})
+				Expect(err).To(MatchError("move failed"))
+
+				students, err := studentRepo.FetchAll(ctx)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(students).To(BeEmpty())
+				_, err = userRepo.FetchByUsername(ctx, "aditira")
+				Expect(err).To(MatchError(gorm.ErrRecordNotFound))
+			})
+
+			It("should roll back and re-panic when the unit of work panics", func() {
+				Expect(func() {
+					transactor.Transaction(ctx, func(ctx context.Context) error {
+						studentRepo.Store(ctx, &model.Student{Name: "John", Address: "Jakarta", ClassId: 1})
+						panic("boom")
+					})
+				}).To(PanicWith("boom"))
+
+				students, err := studentRepo.FetchAll(ctx)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(students).To(BeEmpty())
+			})
+
+			It("should roll back a nested unit of work to its savepoint only", func() {
+				errRollback := errors.New("rollback")
+				err := transactor.Transaction(ctx, func(ctx context.Context) error {
+					if err := studentRepo.Store(ctx, &model.Student{Name: "John", Address: "Jakarta", ClassId: 1}); err != nil {
+						return err
+					}
+					err := transactor.Transaction(ctx, func(ctx context.Context) error {
+						if err := studentRepo.Store(ctx, &model.Student{Name: "Jane", Address: "Bandung", ClassId: 1}); err != nil {
+							return err
+						}
+						return errRollback
+					})
+					Expect(err).To(MatchError(errRollback))
+					return nil
+				})
+				Expect(err).ShouldNot(HaveOccurred())
+
+				students, err := studentRepo.FetchAll(ctx)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(students).To(HaveLen(1))
+				Expect(students[0].Name).To(Equal("John"))
+			})
+		})
+
+		Describe("Health repository", func() {
+			It("should report the schema and default classes that are missing", func() {
+				healthService := service.NewHealthService(repo.NewHealthRepo(conn), model.HealthConfig{
+					Models:  []any{&model.Student{}, &model.Class{}},
+					Classes: []string{"Mathematics"},
+				})
+
+				readiness := healthService.Ready(context.Background())
+				Expect(readiness.Status).To(Equal(model.HealthNotReady))
+				Expect(readiness.Checks).To(HaveLen(3))
+				Expect(readiness.Checks[0].Status).To(Equal(model.HealthOK))
+				Expect(readiness.Checks[1].Status).To(Equal(model.HealthOK))
+				Expect(readiness.Checks[2].Error).To(ContainSubstring("Mathematics"))
+
+				err := conn.Create(&model.Class{Name: "Mathematics", Professor: "Dr. Smith", RoomNumber: 101}).Error
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(healthService.Ready(context.Background()).Status).To(Equal(model.HealthReady))
+
+				err = conn.Migrator().DropIndex(&model.Student{}, "idx_students_deleted_at")
+				Expect(err).ShouldNot(HaveOccurred())
+				readiness = healthService.Ready(context.Background())
+				Expect(readiness.Status).To(Equal(model.HealthNotReady))
+				Expect(readiness.Checks[1].Error).To(ContainSubstring("index idx_students_deleted_at"))
+			})
+		})
+
+		Describe("Tracing", func() {
+			It("should nest the SQL spans under the service span", func() {
+				exporter := tracetest.NewInMemoryExporter()
+				previous := otel.GetTracerProvider()
+				otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+				DeferCleanup(func() { otel.SetTracerProvider(previous) })
+
+				studentService := service.NewStudentService(studentRepo, service.NewAuditService(auditRepo), transactor, model.StudentConfig{})
+				_, err := studentService.FetchWithClass(context.Background())
+				Expect(err).ShouldNot(HaveOccurred())
+
+				spans := exporter.GetSpans()
+				Expect(spans).To(HaveLen(2))
+				Expect(spans[0].Name).To(Equal("row students"))
+				Expect(spans[1].Name).To(Equal("StudentService.FetchWithClass"))
+				Expect(spans[0].Parent.SpanID()).To(Equal(spans[1].SpanContext.SpanID()))
+			})
+		})
+
+		Describe("Password reset repository", func() {
+			When("a user resets their password with a reset token", func() {
+				It("should accept the token exactly once", func() {
+					var outbox bytes.Buffer
+					userService := service.NewUserService(userRepo, passwordResetRepo,
+						service.NewPasswordPolicy(model.PasswordPolicyConfig{}), service.NewWriterNotifier(&outbox), service.NewAuditService(auditRepo), transactor, model.PasswordResetConfig{})
+
+					err := userRepo.Add(ctx, model.User{Username: "aditira", Password: "!opensesame"})
+					Expect(err).ShouldNot(HaveOccurred())
+
+					err = userService.RequestPasswordReset(ctx, "aditira")
+					Expect(err).ShouldNot(HaveOccurred())
+					err = userService.RequestPasswordReset(ctx, "nobody")
+					Expect(err).ShouldNot(HaveOccurred())
+
+					var notification struct {
+						Username string `json:"username"`
+						Token    string `json:"token"`
+					}
+					err = json.NewDecoder(&outbox).Decode(&notification)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(notification.Username).To(Equal("aditira"))
+					Expect(outbox.Len()).To(BeZero())
+
+					username, err := userService.ResetPassword(context.Background(), model.PasswordResetConfirm{Token: notification.Token, NewPassword: "n3w-Secret-pass"})
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(username).To(Equal("aditira"))
+
+					_, err = userService.ResetPassword(context.Background(), model.PasswordResetConfirm{Token: notification.Token, NewPassword: "an0ther-Secret"})
+					Expect(err).To(MatchError(service.ErrInvalidResetToken))
+
+					err = userService.Login(ctx, model.User{Username: "aditira", Password: "n3w-Secret-pass"})
+					Expect(err).ShouldNot(HaveOccurred())
+				})
+			})
+		})
+
+		Describe("Two-factor repository", func() {
+			When("a user enrolls in TOTP and logs in with a challenge", func() {
+				It("should accept each code and recovery code only once", func() {
+					twoFactorService := service.NewTwoFactorService(twoFactorRepo, roleSettingRepo, model.TwoFactorConfig{})
+
+					enrollment, err := twoFactorService.BeginEnrollment(ctx, "aditira")
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(enrollment.URI).To(HavePrefix("otpauth://totp/"))
+
+					code, err := service.TOTPCode(enrollment.Secret, time.Now())
+					Expect(err).ShouldNot(HaveOccurred())
+					recoveryCodes, err := twoFactorService.Activate(ctx, "aditira", code)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(recoveryCodes).To(HaveLen(10))
+
+					challenge, err := twoFactorService.CreateChallenge(ctx, "aditira")
+					Expect(err).ShouldNot(HaveOccurred())
+
+					_, err = twoFactorService.CompleteChallenge(ctx, challenge.Challenge, code)
+					Expect(err).To(MatchError(service.ErrInvalidTwoFactorCode))
+
+					username, err := twoFactorService.CompleteChallenge(ctx, challenge.Challenge, recoveryCodes[0])
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(username).To(Equal("aditira"))
+
+					_, err = twoFactorService.CompleteChallenge(ctx, challenge.Challenge, recoveryCodes[1])
+					Expect(err).To(MatchError(service.ErrInvalidChallenge))
+
+					challenge, err = twoFactorService.CreateChallenge(ctx, "aditira")
+					Expect(err).ShouldNot(HaveOccurred())
+					_, err = twoFactorService.CompleteChallenge(ctx, challenge.Challenge, recoveryCodes[0])
+					Expect(err).To(MatchError(service.ErrInvalidTwoFactorCode))
+				})
+			})
+
+			When("an admin requires two-factor authentication for a role", func() {
+				It("should not let users of that role disable it", func() {
+					twoFactorService := service.NewTwoFactorService(twoFactorRepo, roleSettingRepo, model.TwoFactorConfig{})
+
+					err := twoFactorService.SetRequired(ctx, model.RoleUser, true)
+					Expect(err).ShouldNot(HaveOccurred())
+
+					status, err := twoFactorService.Status(aditira)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(status).To(Equal(model.TwoFactorStatus{Enabled: false, Required: true}))
+
+					err = twoFactorService.Disable(aditira, "123456")
+					Expect(err).To(MatchError(service.ErrTwoFactorRequired))
+				})
+			})
+		})
+
+		Describe("Login attempt repository", func() {
+			When("a username keeps failing to log in", func() {
+				It("should lock it out with a growing delay until an admin unlocks it", func() {
+					loginGuard := service.NewLoginGuard(loginAttemptRepo, model.LockoutConfig{
+						UserThreshold: 3,
+						IPThreshold:   100,
+						BaseDelay:     time.Minute,
+						MaxDelay:      time.Hour,
+					})
+
+					for i := 0; i < 2; i++ {
+						wait, err := loginGuard.RecordFailure(ctx, "aditira", "10.0.0.1")
+						Expect(err).ShouldNot(HaveOccurred())
+						Expect(wait).To(BeZero())
+					}
+
+					wait, err := loginGuard.RecordFailure(ctx, "aditira", "10.0.0.1")
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(wait).To(Equal(time.Minute))
+
+					wait, err = loginGuard.RecordFailure(ctx, "aditira", "10.0.0.1")
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(wait).To(Equal(2 * time.Minute))
+
+					wait, err = loginGuard.Check(ctx, "aditira", "10.0.0.2")
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(wait).To(BeNumerically(">", time.Minute))
+
+					err = loginGuard.Unlock(ctx, "aditira")
+					Expect(err).ShouldNot(HaveOccurred())
+
+					wait, err = loginGuard.Check(ctx, "aditira", "10.0.0.2")
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(wait).To(BeZero())
+				})
+			})
+		})
+
 		Describe("Student repository", func() {
 			When("add student data to students table database postgres", func() {
 				It("should save student data to students table database postgres", func() {
@@ -302,7 +793,7 @@ var _ = Describe("Education Management", func() {
 						Address: "Jl. Raya",
 						ClassId: 1,
 					}
-					err := studentRepo.Store(&student)
+					err := studentRepo.Store(context.Background(), &student)
 					Expect(err).ShouldNot(HaveOccurred())
 
 					result := model.Student{}
@@ -324,7 +815,7 @@ var _ = Describe("Education Management", func() {
 						Address: "Jl. Raya",
 						ClassId: 1,
 					}
-					err := studentRepo.Store(&student1)
+					err := studentRepo.Store(context.Background(), &student1)
 					Expect(err).ShouldNot(HaveOccurred())
 
 					student2 := model.Student{
@@ -332,10 +823,10 @@ var _ = Describe("Education Management", func() {
 						Address: "Jl. Melati",
 						ClassId: 2,
 					}
-					err = studentRepo.Store(&student2)
+					err = studentRepo.Store(context.Background(), &student2)
 					Expect(err).ShouldNot(HaveOccurred())
 
-					result, err := studentRepo.FetchAll()
+					result, err := studentRepo.FetchAll(context.Background())
 					Expect(err).ShouldNot(HaveOccurred())
 					Expect(result).To(HaveLen(2))
 					Expect(result[0].Name).To(Equal(student1.Name))
@@ -353,7 +844,7 @@ var _ = Describe("Education Management", func() {
 						Address: "123 Main St",
 						ClassId: 1,
 					}
-					err := studentRepo.Store(&student)
+					err := studentRepo.Store(context.Background(), &student)
 					Expect(err).ShouldNot(HaveOccurred())
 
 					result := model.Student{}
@@ -376,11 +867,11 @@ var _ = Describe("Education Management", func() {
 					}
 
 					for _, student := range students {
-						err := studentRepo.Store(&student)
+						err := studentRepo.Store(context.Background(), &student)
 						Expect(err).ShouldNot(HaveOccurred())
 					}
 
-					result, err := studentRepo.FetchAll()
+					result, err := studentRepo.FetchAll(context.Background())
 					Expect(err).ShouldNot(HaveOccurred())
 					Expect(len(result)).To(Equal(len(students)))
 
@@ -398,10 +889,10 @@ var _ = Describe("Education Management", func() {
 			When("fetching a single student data by id from students table in the database", func() {
 				It("should return a single student data", func() {
 					student := model.Student{Name: "John", Address: "123 Main St", ClassId: 1}
-					err := studentRepo.Store(&student)
+					err := studentRepo.Store(context.Background(), &student)
 					Expect(err).ShouldNot(HaveOccurred())
 
-					result, err := studentRepo.FetchByID(1)
+					result, err := studentRepo.FetchByID(context.Background(), 1)
 					Expect(err).ShouldNot(HaveOccurred())
 					Expect(result.Name).To(Equal(student.Name))
 					Expect(result.Address).To(Equal(student.Address))
@@ -415,11 +906,11 @@ var _ = Describe("Education Management", func() {
 			When("updating student data in students table in the database", func() {
 				It("should update the existing student data in students table in the database", func() {
 					student := model.Student{Name: "John", Address: "123 Main St", ClassId: 1}
-					err := studentRepo.Store(&student)
+					err := studentRepo.Store(context.Background(), &student)
 					Expect(err).ShouldNot(HaveOccurred())
 
 					newStudent := model.Student{Name: "Jane", Address: "456 Park Ave", ClassId: 2}
-					err = studentRepo.Update(1, &newStudent)
+					err = studentRepo.Update(context.Background(), 1, &newStudent, 1)
 					Expect(err).ShouldNot(HaveOccurred())
 
 					result := model.Student{}
@@ -427,19 +918,83 @@ var _ = Describe("Education Management", func() {
 					Expect(result.Name).To(Equal(newStudent.Name))
 					Expect(result.Address).To(Equal(newStudent.Address))
 					Expect(result.ClassId).To(Equal(newStudent.ClassId))
+					Expect(result.Version).To(Equal(2))
 
 					err = db.Reset(conn, "students")
 					Expect(err).ShouldNot(HaveOccurred())
 				})
+
+				It("should refuse an update based on a stale version", func() {
+					student := model.Student{Name: "John", Address: "123 Main St", ClassId: 1}
+					err := studentRepo.Store(context.Background(), &student)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(student.Version).To(Equal(1))
+
+					err = studentRepo.Update(context.Background(), int(student.ID), &model.Student{Address: "456 Park Ave"}, 1)
+					Expect(err).ShouldNot(HaveOccurred())
+					err = studentRepo.Update(context.Background(), int(student.ID), &model.Student{Address: "789 Elm St"}, 1)
+					Expect(err).To(MatchError(repo.ErrVersionMismatch))
+
+					result, err := studentRepo.FetchByID(context.Background(), int(student.ID))
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(result.Address).To(Equal("456 Park Ave"))
+					Expect(result.Version).To(Equal(2))
+				})
+			})
+
+			When("patching student data with a JSON merge patch", func() {
+				It("should clear null fields and keep the ones left out", func() {
+					studentService := service.NewStudentService(studentRepo, service.NewAuditService(auditRepo), transactor, model.StudentConfig{})
+					student := model.Student{Name: "John", Address: "123 Main St", ClassId: 1}
+					err := studentService.Store(aditira, &student)
+					Expect(err).ShouldNot(HaveOccurred())
+
+					patch := model.StudentPatch{"address": json.RawMessage(`null`), "class_id": json.RawMessage(`0`)}
+					patched, err := studentService.Patch(aditira, int(student.ID), patch, student.Version)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(patched.Name).To(Equal("John"))
+					Expect(patched.Address).To(BeEmpty())
+					Expect(patched.ClassId).To(BeZero())
+					Expect(patched.Version).To(Equal(2))
+
+					_, err = studentService.Patch(aditira, int(student.ID), model.StudentPatch{"version": json.RawMessage(`9`)}, patched.Version)
+					Expect(err).To(MatchError(service.ErrInvalidPatch))
+					_, err = studentService.Patch(aditira, int(student.ID), model.StudentPatch{"name": json.RawMessage(`null`)}, patched.Version)
+					Expect(err).To(MatchError(service.ErrInvalidPatch))
+					_, err = studentService.Patch(aditira, int(student.ID), model.StudentPatch{"name": json.RawMessage(`"Jane"`)}, student.Version)
+					Expect(err).To(MatchError(service.ErrStudentChanged))
+				})
+
+				It("should return the student unchanged for an empty patch", func() {
+					studentService := service.NewStudentService(studentRepo, service.NewAuditService(auditRepo), transactor, model.StudentConfig{})
+					student := model.Student{Name: "John", Address: "123 Main St", ClassId: 1}
+					err := studentService.Store(aditira, &student)
+					Expect(err).ShouldNot(HaveOccurred())
+
+					var events int64
+					conn.Model(&model.AuditEvent{}).Count(&events)
+
+					unchanged, err := studentService.Patch(aditira, int(student.ID), model.StudentPatch{}, student.Version)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(unchanged.Version).To(Equal(student.Version))
+					Expect(unchanged.Address).To(Equal("123 Main St"))
+
+					var after int64
+					conn.Model(&model.AuditEvent{}).Count(&after)
+					Expect(after).To(Equal(events))
+
+					_, err = studentService.Patch(aditira, int(student.ID), model.StudentPatch{}, student.Version+1)
+					Expect(err).To(MatchError(service.ErrStudentChanged))
+				})
 			})
 
 			When("deleting student data in students table in the database", func() {
 				It("should delete the existing student data in students table in the database", func() {
 					student := model.Student{Name: "John", Address: "123 Main St", ClassId: 1}
-					err := studentRepo.Store(&student)
+					err := studentRepo.Store(context.Background(), &student)
 					Expect(err).ShouldNot(HaveOccurred())
 
-					err = studentRepo.Delete(1)
+					err = studentRepo.Delete(context.Background(), 1)
 					Expect(err).ShouldNot(HaveOccurred())
 
 					result := model.Student{}
@@ -451,6 +1006,41 @@ var _ = Describe("Education Management", func() {
 				})
 			})
 
+			When("a deleted student is in the trash", func() {
+				It("should restore it and purge only what is in the trash", func() {
+					student := model.Student{Name: "John", Address: "123 Main St", ClassId: 1}
+					err := studentRepo.Store(context.Background(), &student)
+					Expect(err).ShouldNot(HaveOccurred())
+
+					err = studentRepo.Delete(context.Background(), 1)
+					Expect(err).ShouldNot(HaveOccurred())
+
+					trash, err := studentRepo.FetchTrash(context.Background(), 50, 0)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(trash).To(HaveLen(1))
+					Expect(trash[0].DeletedAt.Valid).To(BeTrue())
+
+					err = studentRepo.Restore(context.Background(), 1)
+					Expect(err).ShouldNot(HaveOccurred())
+
+					err = studentRepo.Purge(context.Background(), 1)
+					Expect(err).To(MatchError(gorm.ErrRecordNotFound))
+
+					err = studentRepo.Delete(context.Background(), 1)
+					Expect(err).ShouldNot(HaveOccurred())
+
+					purged, err := studentRepo.PurgeDeletedBefore(context.Background(), time.Now().Add(time.Hour))
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(purged).To(Equal(int64(1)))
+
+					err = studentRepo.Restore(context.Background(), 1)
+					Expect(err).To(MatchError(gorm.ErrRecordNotFound))
+
+					err = db.Reset(conn, "students")
+					Expect(err).ShouldNot(HaveOccurred())
+				})
+			})
+
 			When("there are students with classes in the DB", func() {
 				BeforeEach(func() {
 					class := model.Class{
@@ -475,10 +1065,10 @@ var _ = Describe("Education Management", func() {
 					}
 
 					student := model.Student{Name: "Jane Doe", Address: "123 Main St", ClassId: 1}
-					err := studentRepo.Store(&student)
+					err := studentRepo.Store(context.Background(), &student)
 					Expect(err).ShouldNot(HaveOccurred())
 
-					actual, err := studentRepo.FetchWithClass()
+					actual, err := studentRepo.FetchWithClass(context.Background())
 					Expect(err).NotTo(HaveOccurred())
 					Expect(actual).To(Equal(&expected))
 
@@ -491,7 +1081,7 @@ var _ = Describe("Education Management", func() {
 				It("should return an empty list", func() {
 					expected := []model.StudentClass{}
 
-					actual, err := studentRepo.FetchWithClass()
+					actual, err := studentRepo.FetchWithClass(context.Background())
 					Expect(err).NotTo(HaveOccurred())
 					Expect(actual).To(Equal(&expected))
 
@@ -550,7 +1140,7 @@ var _ = Describe("Education Management", func() {
 				}
 
 				It("should return all classes", func() {
-					classes, err := classRepo.FetchAll()
+					classes, err := classRepo.FetchAll(context.Background())
 					Expect(err).To(BeNil())
 					Expect(classes).To(HaveLen(3))
 					Expect(classes).To(ConsistOf(expectedClasses))
@@ -564,7 +1154,7 @@ var _ = Describe("Education Management", func() {
 				})
 
 				It("should return an empty list of classes", func() {
-					classes, err := classRepo.FetchAll()
+					classes, err := classRepo.FetchAll(context.Background())
 					Expect(err).To(BeNil())
 					Expect(classes).To(HaveLen(0))
 				})
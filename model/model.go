@@ -1,30 +1,316 @@
 package model
 
 import (
+	"encoding/json"
+	"log/slog"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"gorm.io/gorm"
 )
 
 type User struct {
 	gorm.Model
-	Username string `gorm:"type:varchar(100);unique"`
+	Username    string `gorm:"type:varchar(100);unique"`
+	Password    string `json:"password"`
+	Role        string `gorm:"type:varchar(20);default:user" json:"-"`
+	DisplayName string `gorm:"type:varchar(100)" json:"display_name"`
+	Email       string `gorm:"type:varchar(255)" json:"email"`
+	LastLoginAt *time.Time
+	Disabled    bool `gorm:"not null;default:false"`
+}
+
+type UserProfile struct {
+	Username    string     `json:"username"`
+	DisplayName string     `json:"display_name"`
+	Email       string     `json:"email"`
+	Role        string     `json:"role"`
+	Disabled    bool       `json:"disabled"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+}
+
+type ProfileUpdate struct {
+	DisplayName *string `json:"display_name"`
+	Email       *string `json:"email"`
+}
+
+type AccountDeleteRequest struct {
 	Password string `json:"password"`
 }
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+type PasswordPolicyConfig struct {
+	MinLength        int
+	MinCharClasses   int
+	Blocklist        []string
+	DisallowUsername bool
+}
+
+type PasswordChangeRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type PasswordResetRequest struct {
+	Username string `json:"username"`
+}
+
+type PasswordResetConfirm struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+type PasswordResetToken struct {
+	ID        uint   `gorm:"primaryKey"`
+	Username  string `gorm:"index"`
+	Hash      string `gorm:"uniqueIndex"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+type PasswordResetConfig struct {
+	TokenTTL time.Duration
+}
+
+type TwoFactor struct {
+	ID           uint       `gorm:"primaryKey"`
+	Username     string     `gorm:"uniqueIndex"`
+	Secret       string     `json:"-"` // base32, stored unencrypted
+	Enabled      bool       `json:"enabled"`
+	LastUsedStep int64      `json:"-"`
+	EnabledAt    *time.Time `json:"enabled_at"`
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+type RecoveryCode struct {
+	ID       uint   `gorm:"primaryKey"`
+	Username string `gorm:"index"`
+	Hash     string
+	UsedAt   *time.Time
+}
+
+type LoginChallenge struct {
+	ID        uint   `gorm:"primaryKey"`
+	Username  string `gorm:"index"`
+	Hash      string `gorm:"uniqueIndex"`
+	ExpiresAt time.Time
+	Attempts  int
+}
+
+type RoleSetting struct {
+	Role             string `gorm:"primaryKey;type:varchar(20)" json:"role"`
+	RequireTwoFactor bool   `json:"require_two_factor"`
+}
+
+type TwoFactorConfig struct {
+	Issuer       string
+	ChallengeTTL time.Duration
+	MaxAttempts  int
+}
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type TwoFactorStatus struct {
+	Enabled  bool `json:"enabled"`
+	Required bool `json:"required"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type TwoFactorLoginRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+type LoginChallengeResponse struct {
+	Username  string    `json:"username"`
+	Challenge string    `json:"challenge"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Message   string    `json:"message"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type RoleTwoFactorRequest struct {
+	Required bool `json:"required"`
+}
+
+type LoginAttempt struct {
+	ID            uint      `gorm:"primaryKey"`
+	Kind          string    `gorm:"uniqueIndex:idx_login_attempts_kind_key"`
+	Key           string    `gorm:"uniqueIndex:idx_login_attempts_kind_key"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+	LockedUntil   time.Time `json:"locked_until"`
+}
+
+const (
+	LoginAttemptUser = "user"
+	LoginAttemptIP   = "ip"
+)
+
+type LockoutConfig struct {
+	// KindPrefix is prepended to the login_attempts kinds, so guards for
+	// different actions keep separate counters in the same table.
+	KindPrefix    string
+	UserThreshold int
+	IPThreshold   int
+	Window        time.Duration
+	BaseDelay     time.Duration
+	MaxDelay      time.Duration
+}
 type Session struct {
 	gorm.Model
-	Token    string    `json:"token"`
-	Username string    `json:"username"`
-	Expiry   time.Time `json:"expiry"`
+	Token     string    `gorm:"uniqueIndex" json:"token"`
+	Username  string    `gorm:"index" json:"username"`
+	Expiry    time.Time `json:"expiry"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+}
+
+type SessionInfo struct {
+	ID        uint      `json:"id"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+	Expiry    time.Time `json:"expiry"`
+	Current   bool      `json:"current"`
+}
+
+type SessionConfig struct {
+	MaxActive       int
+	IdleTimeout     time.Duration
+	MaxLifetime     time.Duration
+	RefreshThrottle time.Duration
+}
+
+const (
+	SessionModeOpaque = "opaque"
+	SessionModeJWT    = "jwt"
+)
+
+type JWTConfig struct {
+	Algorithm   string
+	Keys        map[string][]byte
+	ActiveKeyID string
+	AccessTTL   time.Duration
+	Issuer      string
+}
+
+type AccessClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	UserID    uint   `json:"uid"`
+	Role      string `json:"role"`
+	SessionID uint   `json:"sid"`
+	ID        string `json:"jti"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type RevokedToken struct {
+	ID        uint      `gorm:"primaryKey"`
+	Key       string    `gorm:"uniqueIndex"`
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+type CookieConfig struct {
+	Path     string
+	Domain   string
+	Secure   bool
+	HttpOnly bool
+	SameSite string
+}
+
+type APIConfig struct {
+	Cookie         CookieConfig
+	CSRFSecret     string
+	Logger         *slog.Logger
+	Metrics        *prometheus.Registry
+	DrainDelay     time.Duration
+	RequestTimeout time.Duration
+}
+
+type ReaperConfig struct {
+	Interval  time.Duration
+	BatchSize int
+	// MaxLifetime matches SessionConfig.MaxLifetime, so the active count
+	// leaves out sessions that are too old to use.
+	MaxLifetime time.Duration
+	Logger      *slog.Logger
 }
 
+type ReaperStats struct {
+	LastRunAt  time.Time `json:"last_run_at"`
+	DurationMs int64     `json:"duration_ms"`
+	Deleted    int64     `json:"deleted"`
+	Batches    int       `json:"batches"`
+	Active     int64     `json:"active"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type APIKey struct {
+	gorm.Model
+	Username   string     `gorm:"index" json:"username"`
+	Name       string     `json:"name"`
+	Prefix     string     `gorm:"uniqueIndex:idx_api_keys_live_prefix,where:deleted_at IS NULL" json:"prefix"`
+	Hash       string     `json:"-"`
+	Scopes     []string   `gorm:"serializer:json" json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+type APIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type APIKeyCreated struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+const (
+	ScopeStudentsRead  = "students:read"
+	ScopeStudentsWrite = "students:write"
+	ScopeClassesRead   = "classes:read"
+	ScopeMetricsRead   = "metrics:read"
+	ScopeAccount       = "account"
+)
+
+// APIKeyScopes are the scopes that can be granted to an API key. ScopeAccount
+// is deliberately missing: managing sessions and keys needs a real login.
+var APIKeyScopes = []string{ScopeStudentsRead, ScopeStudentsWrite, ScopeClassesRead, ScopeMetricsRead}
+
 type Student struct {
 	gorm.Model
 	Name    string `json:"name"`
 	Address string `json:"address"`
 	ClassId int    `json:"class_id"`
+	// Version starts at 1 and goes up by one on every update; it backs the
+	// ETag of the student.
+	Version int `gorm:"not null;default:1" json:"version"`
 }
 
+// StudentPatch is a JSON Merge Patch (RFC 7396) of a student: a field left
+// out is kept and a field set to null is cleared.
+type StudentPatch map[string]json.RawMessage
+
 type Class struct {
 	ID         int    `gorm:"primaryKey"`
 	Name       string `json:"name"`
@@ -40,6 +326,54 @@ type StudentClass struct {
 	RoomNumber int    `json:"room_number"`
 }
 
+const (
+	AuditEntityStudent = "student"
+	AuditEntityClass   = "class"
+	AuditEntityUser    = "user"
+
+	AuditActionCreate         = "create"
+	AuditActionUpdate         = "update"
+	AuditActionDelete         = "delete"
+	AuditActionLogin          = "login"
+	AuditActionPasswordChange = "password_change"
+	AuditActionPasswordReset  = "password_reset"
+	AuditActionDisable        = "disable"
+	AuditActionEnable         = "enable"
+	AuditActionRestore        = "restore"
+	AuditActionPurge          = "purge"
+)
+
+// AuditEvent is an entry of the append-only audit log. Before and After only
+// hold the fields the change touched. Actor is empty for changes made by an
+// unauthenticated caller or from the command line.
+type AuditEvent struct {
+	ID        uint           `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time      `gorm:"index" json:"created_at"`
+	Actor     string         `gorm:"index" json:"actor"`
+	Action    string         `json:"action"`
+	Entity    string         `gorm:"index:idx_audit_events_entity" json:"entity"`
+	EntityID  string         `gorm:"index:idx_audit_events_entity" json:"entity_id"`
+	Before    map[string]any `gorm:"serializer:json" json:"before,omitempty"`
+	After     map[string]any `gorm:"serializer:json" json:"after,omitempty"`
+	RequestID string         `json:"request_id"`
+	IP        string         `json:"ip"`
+}
+
+type StudentConfig struct {
+	TrashRetention time.Duration
+}
+
+type PurgeResponse struct {
+	Purged int64 `json:"purged"`
+}
+
+type AuditFilter struct {
+	Entity   string
+	EntityID string
+	Actor    string
+	Action   string
+}
+
 type Credential struct {
 	Host                    string
 	HostAlternative         string
@@ -55,12 +389,57 @@ type Credential struct {
 	SchemaAlternative       string
 }
 
-
 type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
+type PasswordPolicyResponse struct {
+	Error      string   `json:"error"`
+	Violations []string `json:"violations"`
+}
+
 type SuccessResponse struct {
 	Username string `json:"username"`
 	Message  string `json:"message"`
 }
+
+type TokenResponse struct {
+	Username string    `json:"username"`
+	Token    string    `json:"token"`
+	Expiry   time.Time `json:"expiry"`
+}
+
+type TokenPair struct {
+	Username         string    `json:"username"`
+	AccessToken      string    `json:"access_token"`
+	TokenType        string    `json:"token_type"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	RefreshToken     string    `json:"refresh_token"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+type HealthConfig struct {
+	Timeout time.Duration
+	Models  []any
+	Classes []string
+}
+
+const (
+	HealthOK       = "ok"
+	HealthFailing  = "failing"
+	HealthReady    = "ready"
+	HealthNotReady = "not_ready"
+	HealthDraining = "shutting_down"
+)
+
+type HealthCheck struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type Readiness struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks,omitempty"`
+}
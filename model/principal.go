@@ -0,0 +1,53 @@
+package model
+
+import (
+	"context"
+	"slices"
+)
+
+const (
+	AuthMethodSession = "session"
+	AuthMethodJWT     = "jwt"
+	AuthMethodAPIKey  = "api_key"
+)
+
+// Principal is the authenticated caller of a request. SessionID is set for
+// session and JWT callers, APIKeyID and Scopes only for API keys.
+type Principal struct {
+	UserID    uint
+	Username  string
+	Roles     []string
+	SessionID uint
+	APIKeyID  uint
+	Method    string
+	Scopes    []string
+}
+
+func (p Principal) HasRole(role string) bool {
+	return slices.Contains(p.Roles, role)
+}
+
+// HasScope reports whether the caller may use scope. Sessions and JWTs act as
+// the user themselves and hold every scope; API keys only hold the ones
+// granted, and any other method holds none.
+func (p Principal) HasScope(scope string) bool {
+	switch p.Method {
+	case AuthMethodSession, AuthMethodJWT:
+		return true
+	case AuthMethodAPIKey:
+		return slices.Contains(p.Scopes, scope)
+	default:
+		return false
+	}
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
@@ -0,0 +1,47 @@
+package main_test
+
+import (
+	"errors"
+
+	"a21hc3NpZ25tZW50/model"
+	"a21hc3NpZ25tZW50/service"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Password policy", func() {
+	policy := service.NewPasswordPolicy(model.PasswordPolicyConfig{
+		MinLength:        10,
+		MinCharClasses:   3,
+		Blocklist:        []string{"Tr0ub4dor&3"},
+		DisallowUsername: true,
+	})
+
+	When("the password satisfies every rule", func() {
+		It("should accept it", func() {
+			Expect(policy.Validate("aditira", "correct-Horse-7")).To(Succeed())
+		})
+	})
+
+	When("the password breaks several rules", func() {
+		It("should report all of them at once", func() {
+			err := policy.Validate("aditira", "aditira")
+
+			var policyErr *service.PasswordPolicyError
+			Expect(errors.As(err, &policyErr)).To(BeTrue())
+			Expect(policyErr.Violations).To(HaveLen(3))
+			Expect(policyErr.Violations).To(ContainElement("must not contain the username"))
+		})
+	})
+
+	When("the password is on a blocklist", func() {
+		It("should reject built-in and configured entries regardless of case", func() {
+			for _, password := range []string{"P@ssw0rd", "tr0ub4dor&3"} {
+				var policyErr *service.PasswordPolicyError
+				Expect(errors.As(policy.Validate("someone", password), &policyErr)).To(BeTrue())
+				Expect(policyErr.Violations).To(ContainElement("is too common"))
+			}
+		})
+	})
+})
@@ -0,0 +1,53 @@
+package main_test
+
+import (
+	"context"
+
+	"a21hc3NpZ25tZW50/model"
+	"a21hc3NpZ25tZW50/service"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Principal", func() {
+	It("should round-trip through the context", func() {
+		_, ok := model.PrincipalFrom(context.Background())
+		Expect(ok).To(BeFalse())
+
+		principal := model.Principal{Username: "aditira", Roles: []string{model.RoleUser}, Method: model.AuthMethodSession}
+		got, ok := model.PrincipalFrom(model.WithPrincipal(context.Background(), principal))
+		Expect(ok).To(BeTrue())
+		Expect(got.Username).To(Equal("aditira"))
+		Expect(got.HasRole(model.RoleUser)).To(BeTrue())
+		Expect(got.HasRole(model.RoleAdmin)).To(BeFalse())
+	})
+
+	It("should limit API keys to their granted scopes", func() {
+		session := model.Principal{Method: model.AuthMethodSession}
+		apiKey := model.Principal{Method: model.AuthMethodAPIKey, Scopes: []string{model.ScopeStudentsRead}}
+
+		Expect(session.HasScope(model.ScopeStudentsWrite)).To(BeTrue())
+		Expect(apiKey.HasScope(model.ScopeStudentsRead)).To(BeTrue())
+		Expect(apiKey.HasScope(model.ScopeStudentsWrite)).To(BeFalse())
+	})
+
+	It("should grant no scope to a principal without an auth method", func() {
+		Expect(model.Principal{Username: "aditira"}.HasScope(model.ScopeAccount)).To(BeFalse())
+	})
+
+	It("should let services refuse callers before touching the repository", func() {
+		studentService := service.NewStudentService(nil, nil, nil, model.StudentConfig{})
+
+		err := studentService.Delete(context.Background(), 1)
+		Expect(err).To(MatchError(service.ErrUnauthenticated))
+
+		ctx := model.WithPrincipal(context.Background(), model.Principal{
+			Username: "aditira",
+			Method:   model.AuthMethodAPIKey,
+			Scopes:   []string{model.ScopeStudentsRead},
+		})
+		err = studentService.Delete(ctx, 1)
+		Expect(err).To(MatchError(service.ErrForbidden))
+	})
+})
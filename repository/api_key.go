@@ -0,0 +1,61 @@
+package repository
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type APIKeyRepository interface {
+	Add(ctx context.Context, key *model.APIKey) error
+	FetchByPrefix(ctx context.Context, prefix string) (model.APIKey, error)
+	FetchByUsername(ctx context.Context, username string) ([]model.APIKey, error)
+	Delete(ctx context.Context, username string, id uint) error
+	DeleteByUsername(ctx context.Context, username string) error
+	UpdateLastUsed(ctx context.Context, id uint, usedAt time.Time) error
+}
+
+type apiKeyRepoImpl struct {
+	db *gorm.DB
+}
+
+func NewAPIKeyRepo(db *gorm.DB) *apiKeyRepoImpl {
+	return &apiKeyRepoImpl{db}
+}
+
+func (a *apiKeyRepoImpl) Add(ctx context.Context, key *model.APIKey) error {
+	return translateError(conn(ctx, a.db).Create(key).Error)
+}
+
+func (a *apiKeyRepoImpl) FetchByPrefix(ctx context.Context, prefix string) (model.APIKey, error) {
+	var key model.APIKey
+	err := conn(ctx, a.db).Where("prefix = ?", prefix).First(&key).Error
+	return key, err
+}
+
+func (a *apiKeyRepoImpl) FetchByUsername(ctx context.Context, username string) ([]model.APIKey, error) {
+	var keys []model.APIKey
+	err := conn(ctx, a.db).Where("username = ?", username).Order("created_at desc").Find(&keys).Error
+	return keys, err
+}
+
+func (a *apiKeyRepoImpl) Delete(ctx context.Context, username string, id uint) error {
+	result := conn(ctx, a.db).Where("username = ? AND id = ?", username, id).Delete(&model.APIKey{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (a *apiKeyRepoImpl) UpdateLastUsed(ctx context.Context, id uint, usedAt time.Time) error {
+	return conn(ctx, a.db).Model(&model.APIKey{}).Where("id = ?", id).Update("last_used_at", usedAt).Error
+}
+
+func (a *apiKeyRepoImpl) DeleteByUsername(ctx context.Context, username string) error {
+	return conn(ctx, a.db).Where("username = ?", username).Delete(&model.APIKey{}).Error
+}
@@ -0,0 +1,49 @@
+package repository
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"context"
+
+	"gorm.io/gorm"
+)
+
+// AuditRepository only appends to and reads the audit log; events are never
+// updated or deleted.
+type AuditRepository interface {
+	Add(ctx context.Context, event *model.AuditEvent) error
+	Fetch(ctx context.Context, filter model.AuditFilter, limit, offset int) ([]model.AuditEvent, error)
+}
+
+type auditRepoImpl struct {
+	db *gorm.DB
+}
+
+func NewAuditRepo(db *gorm.DB) *auditRepoImpl {
+	return &auditRepoImpl{db}
+}
+
+func (a *auditRepoImpl) Add(ctx context.Context, event *model.AuditEvent) error {
+	return conn(ctx, a.db).Create(event).Error
+}
+
+// Fetch returns the events matching every non-empty field of filter, newest
+// first.
+func (a *auditRepoImpl) Fetch(ctx context.Context, filter model.AuditFilter, limit, offset int) ([]model.AuditEvent, error) {
+	query := conn(ctx, a.db).Model(&model.AuditEvent{})
+	if filter.Entity != "" {
+		query = query.Where("entity = ?", filter.Entity)
+	}
+	if filter.EntityID != "" {
+		query = query.Where("entity_id = ?", filter.EntityID)
+	}
+	if filter.Actor != "" {
+		query = query.Where("actor = ?", filter.Actor)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+
+	events := []model.AuditEvent{}
+	err := query.Order("id DESC").Limit(limit).Offset(offset).Find(&events).Error
+	return events, err
+}
@@ -2,12 +2,13 @@ package repository
 
 import (
 	"a21hc3NpZ25tZW50/model"
+	"context"
 
 	"gorm.io/gorm"
 )
 
 type ClassRepository interface {
-	FetchAll() ([]model.Class, error)
+	FetchAll(ctx context.Context) ([]model.Class, error)
 }
 
 type classRepoImpl struct {
@@ -18,8 +19,8 @@ func NewClassRepo(db *gorm.DB) *classRepoImpl {
 	return &classRepoImpl{db}
 }
 
-func (s *classRepoImpl) FetchAll() ([]model.Class, error) {
+func (s *classRepoImpl) FetchAll(ctx context.Context) ([]model.Class, error) {
 	var classes []model.Class
-	err := s.db.Find(&classes).Error
+	err := conn(ctx, s.db).Find(&classes).Error
 	return classes, err
 }
@@ -0,0 +1,32 @@
+package repository
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net"
+
+	"github.com/jackc/pgconn"
+)
+
+var (
+	// ErrDuplicateKey is returned when a write violates a unique index.
+	ErrDuplicateKey = errors.New("duplicate key")
+	// ErrVersionMismatch is returned when a row was changed after the version
+	// the caller based its write on.
+	ErrVersionMismatch = errors.New("version mismatch")
+)
+
+func translateError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return ErrDuplicateKey
+	}
+	return err
+}
+
+// Unavailable reports whether err means the database could not be reached,
+// as opposed to the query itself failing.
+func Unavailable(err error) bool {
+	var netErr *net.OpError
+	return errors.Is(err, driver.ErrBadConn) || errors.As(err, &netErr)
+}
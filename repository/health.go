@@ -0,0 +1,108 @@
+package repository
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"context"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+type HealthRepository interface {
+	Ping(ctx context.Context) error
+	MissingSchema(ctx context.Context, models []any) ([]string, error)
+	MissingClasses(ctx context.Context, names []string) ([]string, error)
+}
+
+type healthRepoImpl struct {
+	db *gorm.DB
+}
+
+func NewHealthRepo(db *gorm.DB) *healthRepoImpl {
+	return &healthRepoImpl{db}
+}
+
+func (h *healthRepoImpl) Ping(ctx context.Context) error {
+	sqlDB, err := h.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
+
+// MissingSchema lists the tables, columns and indexes of models that
+// AutoMigrate would still have to create. It reads the catalog in two queries
+// rather than asking the migrator about every column.
+func (h *healthRepoImpl) MissingSchema(ctx context.Context, models []any) ([]string, error) {
+	db := h.db.WithContext(ctx)
+
+	var columns []struct{ TableName, ColumnName string }
+	err := db.Raw("SELECT table_name, column_name FROM information_schema.columns WHERE table_schema = CURRENT_SCHEMA()").
+		Scan(&columns).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var indexes []string
+	err = db.Raw("SELECT indexname FROM pg_indexes WHERE schemaname = CURRENT_SCHEMA()").Scan(&indexes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	existing := map[string]bool{}
+	for _, column := range columns {
+		existing[column.TableName] = true
+		existing[column.TableName+"."+column.ColumnName] = true
+	}
+	for _, index := range indexes {
+		existing["index "+index] = true
+	}
+
+	var missing []string
+	for _, m := range models {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(m); err != nil {
+			return nil, err
+		}
+
+		table := stmt.Schema.Table
+		if !existing[table] {
+			missing = append(missing, "table "+table)
+			continue
+		}
+		for _, column := range stmt.Schema.DBNames {
+			if !existing[table+"."+column] {
+				missing = append(missing, fmt.Sprintf("column %s.%s", table, column))
+			}
+		}
+		for _, index := range stmt.Schema.ParseIndexes() {
+			if !existing["index "+index.Name] {
+				missing = append(missing, "index "+index.Name)
+			}
+		}
+	}
+	return missing, nil
+}
+
+func (h *healthRepoImpl) MissingClasses(ctx context.Context, names []string) ([]string, error) {
+	var found []string
+	err := h.db.WithContext(ctx).Model(&model.Class{}).
+		Where("name IN ?", names).
+		Distinct("name").Pluck("name", &found).Error
+	if err != nil {
+		return nil, err
+	}
+
+	present := map[string]bool{}
+	for _, name := range found {
+		present[name] = true
+	}
+
+	var missing []string
+	for _, name := range names {
+		if !present[name] {
+			missing = append(missing, name)
+		}
+	}
+	return missing, nil
+}
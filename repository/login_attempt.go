@@ -0,0 +1,62 @@
+package repository
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type LoginAttemptRepository interface {
+	Fetch(ctx context.Context, kind, key string) (model.LoginAttempt, error)
+	RecordFailure(ctx context.Context, kind, key string, at time.Time, window time.Duration) (model.LoginAttempt, error)
+	Lock(ctx context.Context, kind, key string, until time.Time) error
+	Reset(ctx context.Context, kind, key string) error
+}
+
+type loginAttemptRepoImpl struct {
+	db *gorm.DB
+}
+
+func NewLoginAttemptRepo(db *gorm.DB) *loginAttemptRepoImpl {
+	return &loginAttemptRepoImpl{db}
+}
+
+func (l *loginAttemptRepoImpl) Fetch(ctx context.Context, kind, key string) (model.LoginAttempt, error) {
+	var attempt model.LoginAttempt
+	err := conn(ctx, l.db).Where("kind = ? AND key = ?", kind, key).First(&attempt).Error
+	return attempt, err
+}
+
+// RecordFailure atomically counts a failed login, so concurrent attempts
+// against several server instances are all accounted for. Failures older than
+// window no longer count and the streak restarts at one.
+func (l *loginAttemptRepoImpl) RecordFailure(ctx context.Context, kind, key string, at time.Time, window time.Duration) (model.LoginAttempt, error) {
+	attempt := model.LoginAttempt{Kind: kind, Key: key, Failures: 1, LastFailureAt: at}
+
+	err := conn(ctx, l.db).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "kind"}, {Name: "key"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"failures":        gorm.Expr("CASE WHEN login_attempts.last_failure_at < ? THEN 1 ELSE login_attempts.failures + 1 END", at.Add(-window)),
+				"last_failure_at": at,
+			}),
+		}).Create(&attempt).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Where("kind = ? AND key = ?", kind, key).First(&attempt).Error
+	})
+	return attempt, err
+}
+
+func (l *loginAttemptRepoImpl) Lock(ctx context.Context, kind, key string, until time.Time) error {
+	return conn(ctx, l.db).Model(&model.LoginAttempt{}).Where("kind = ? AND key = ?", kind, key).Update("locked_until", until).Error
+}
+
+func (l *loginAttemptRepoImpl) Reset(ctx context.Context, kind, key string) error {
+	return conn(ctx, l.db).Where("kind = ? AND key = ?", kind, key).Delete(&model.LoginAttempt{}).Error
+}
@@ -0,0 +1,53 @@
+package repository
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type PasswordResetRepository interface {
+	Add(ctx context.Context, token *model.PasswordResetToken) error
+	FetchActive(ctx context.Context, hash string, now time.Time) (model.PasswordResetToken, error)
+	MarkUsed(ctx context.Context, id uint, at time.Time) error
+	DeleteByUsername(ctx context.Context, username string) error
+}
+
+type passwordResetRepoImpl struct {
+	db *gorm.DB
+}
+
+func NewPasswordResetRepo(db *gorm.DB) *passwordResetRepoImpl {
+	return &passwordResetRepoImpl{db}
+}
+
+func (p *passwordResetRepoImpl) Add(ctx context.Context, token *model.PasswordResetToken) error {
+	return conn(ctx, p.db).Create(token).Error
+}
+
+func (p *passwordResetRepoImpl) FetchActive(ctx context.Context, hash string, now time.Time) (model.PasswordResetToken, error) {
+	var token model.PasswordResetToken
+	err := conn(ctx, p.db).Where("hash = ? AND used_at IS NULL AND expires_at > ?", hash, now).First(&token).Error
+	return token, err
+}
+
+// MarkUsed consumes the token. It only matches an unused token, so when two
+// requests race with the same token exactly one of them succeeds.
+func (p *passwordResetRepoImpl) MarkUsed(ctx context.Context, id uint, at time.Time) error {
+	result := conn(ctx, p.db).Model(&model.PasswordResetToken{}).
+		Where("id = ? AND used_at IS NULL", id).
+		Update("used_at", at)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (p *passwordResetRepoImpl) DeleteByUsername(ctx context.Context, username string) error {
+	return conn(ctx, p.db).Where("username = ?", username).Delete(&model.PasswordResetToken{}).Error
+}
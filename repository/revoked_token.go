@@ -0,0 +1,38 @@
+package repository
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type RevokedTokenRepository interface {
+	Add(ctx context.Context, token model.RevokedToken) error
+	FetchActive(ctx context.Context, now time.Time) ([]model.RevokedToken, error)
+	DeleteExpired(ctx context.Context, before time.Time) error
+}
+
+type revokedTokenRepoImpl struct {
+	db *gorm.DB
+}
+
+func NewRevokedTokenRepo(db *gorm.DB) *revokedTokenRepoImpl {
+	return &revokedTokenRepoImpl{db}
+}
+
+func (r *revokedTokenRepoImpl) Add(ctx context.Context, token model.RevokedToken) error {
+	return conn(ctx, r.db).Clauses(clause.OnConflict{DoNothing: true}).Create(&token).Error
+}
+
+func (r *revokedTokenRepoImpl) FetchActive(ctx context.Context, now time.Time) ([]model.RevokedToken, error) {
+	var tokens []model.RevokedToken
+	err := conn(ctx, r.db).Where("expires_at > ?", now).Find(&tokens).Error
+	return tokens, err
+}
+
+func (r *revokedTokenRepoImpl) DeleteExpired(ctx context.Context, before time.Time) error {
+	return conn(ctx, r.db).Where("expires_at <= ?", before).Delete(&model.RevokedToken{}).Error
+}
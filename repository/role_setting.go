@@ -0,0 +1,32 @@
+package repository
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"context"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type RoleSettingRepository interface {
+	Fetch(ctx context.Context, role string) (model.RoleSetting, error)
+	Save(ctx context.Context, setting model.RoleSetting) error
+}
+
+type roleSettingRepoImpl struct {
+	db *gorm.DB
+}
+
+func NewRoleSettingRepo(db *gorm.DB) *roleSettingRepoImpl {
+	return &roleSettingRepoImpl{db}
+}
+
+func (r *roleSettingRepoImpl) Fetch(ctx context.Context, role string) (model.RoleSetting, error) {
+	var setting model.RoleSetting
+	err := conn(ctx, r.db).Where("role = ?", role).First(&setting).Error
+	return setting, err
+}
+
+func (r *roleSettingRepoImpl) Save(ctx context.Context, setting model.RoleSetting) error {
+	return conn(ctx, r.db).Clauses(clause.OnConflict{UpdateAll: true}).Create(&setting).Error
+}
@@ -2,16 +2,26 @@ package repository
 
 import (
 	"a21hc3NpZ25tZW50/model"
+	"context"
+	"time"
 
 	"gorm.io/gorm"
 )
 
 type SessionsRepository interface {
-	AddSessions(session model.Session) error
-	DeleteSession(token string) error
-	UpdateSessions(session model.Session) error
-	SessionAvailName(name string) error
-	SessionAvailToken(token string) (model.Session, error)
+	AddSessions(ctx context.Context, session model.Session) error
+	DeleteSession(ctx context.Context, token string) error
+	UpdateSessions(ctx context.Context, session model.Session) error
+	SessionAvailName(ctx context.Context, name string) error
+	SessionAvailToken(ctx context.Context, token string) (model.Session, error)
+	FetchByUsername(ctx context.Context, username string) ([]model.Session, error)
+	DeleteByID(ctx context.Context, username string, id uint) error
+	DeleteByUsername(ctx context.Context, username string) error
+	DeleteOthers(ctx context.Context, username string, keepID uint) error
+	DeleteExpired(ctx context.Context, before time.Time, limit int) (int64, error)
+	CountActive(ctx context.Context, expiresAfter, createdAfter time.Time) (int64, error)
+	UpdateExpiry(ctx context.Context, id uint, expiry time.Time) error
+	RotateToken(ctx context.Context, id uint, token string, expiry time.Time) error
 }
 
 type sessionsRepoImpl struct {
@@ -22,31 +32,89 @@ func NewSessionRepo(db *gorm.DB) *sessionsRepoImpl {
 	return &sessionsRepoImpl{db}
 }
 
-func (s *sessionsRepoImpl) AddSessions(session model.Session) error {
-	if err := s.db.Create(&session).Error; err != nil {
+func (s *sessionsRepoImpl) AddSessions(ctx context.Context, session model.Session) error {
+	if err := conn(ctx, s.db).Create(&session).Error; err != nil {
 		return err
 	}
 	return nil
 }
 
-func (s *sessionsRepoImpl) DeleteSession(token string) error {
-	return s.db.Where("token = ?", token).Delete(&model.Session{}).Error
+func (s *sessionsRepoImpl) DeleteSession(ctx context.Context, token string) error {
+	return conn(ctx, s.db).Where("token = ?", token).Delete(&model.Session{}).Error
 }
 
-func (s *sessionsRepoImpl) UpdateSessions(session model.Session) error {
-	if err := s.db.Model(&model.Session{}).Where("username = ?", session.Username).Updates(session).Error; err != nil {
+func (s *sessionsRepoImpl) UpdateSessions(ctx context.Context, session model.Session) error {
+	if err := conn(ctx, s.db).Model(&model.Session{}).Where("username = ?", session.Username).Updates(session).Error; err != nil {
 		return err
 	}
 	return nil
 }
 
-func (s *sessionsRepoImpl) SessionAvailName(name string) error {
+func (s *sessionsRepoImpl) SessionAvailName(ctx context.Context, name string) error {
 	var session model.Session
-	return s.db.Where("username = ?", name).First(&session).Error
+	return conn(ctx, s.db).Where("username = ?", name).First(&session).Error
 }
 
-func (s *sessionsRepoImpl) SessionAvailToken(token string) (model.Session, error) {
+func (s *sessionsRepoImpl) SessionAvailToken(ctx context.Context, token string) (model.Session, error) {
 	var session model.Session
-	err := s.db.Where("token = ?", token).First(&session).Error
+	err := conn(ctx, s.db).Where("token = ?", token).First(&session).Error
 	return session, err
 }
+
+func (s *sessionsRepoImpl) FetchByUsername(ctx context.Context, username string) ([]model.Session, error) {
+	var sessions []model.Session
+	err := conn(ctx, s.db).Where("username = ?", username).Order("created_at desc").Find(&sessions).Error
+	return sessions, err
+}
+
+func (s *sessionsRepoImpl) DeleteByID(ctx context.Context, username string, id uint) error {
+	result := conn(ctx, s.db).Where("username = ? AND id = ?", username, id).Delete(&model.Session{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (s *sessionsRepoImpl) DeleteByUsername(ctx context.Context, username string) error {
+	return conn(ctx, s.db).Where("username = ?", username).Delete(&model.Session{}).Error
+}
+
+func (s *sessionsRepoImpl) DeleteOthers(ctx context.Context, username string, keepID uint) error {
+	return conn(ctx, s.db).Where("username = ? AND id <> ?", username, keepID).Delete(&model.Session{}).Error
+}
+
+// DeleteExpired permanently removes up to limit sessions that expired before
+// the given time or were already soft-deleted by a logout or revocation.
+func (s *sessionsRepoImpl) DeleteExpired(ctx context.Context, before time.Time, limit int) (int64, error) {
+	expired := conn(ctx, s.db).Unscoped().Model(&model.Session{}).
+		Select("id").
+		Where("expiry < ? OR deleted_at IS NOT NULL", before).
+		Limit(limit)
+
+	result := conn(ctx, s.db).Unscoped().Where("id IN (?)", expired).Delete(&model.Session{})
+	return result.RowsAffected, result.Error
+}
+
+// CountActive counts the live sessions that expire after expiresAfter and
+// were created after createdAfter.
+func (s *sessionsRepoImpl) CountActive(ctx context.Context, expiresAfter, createdAfter time.Time) (int64, error) {
+	var count int64
+	err := conn(ctx, s.db).Model(&model.Session{}).
+		Where("expiry > ? AND created_at > ?", expiresAfter, createdAfter).
+		Count(&count).Error
+	return count, err
+}
+
+func (s *sessionsRepoImpl) UpdateExpiry(ctx context.Context, id uint, expiry time.Time) error {
+	return conn(ctx, s.db).Model(&model.Session{}).Where("id = ?", id).Update("expiry", expiry).Error
+}
+
+func (s *sessionsRepoImpl) RotateToken(ctx context.Context, id uint, token string, expiry time.Time) error {
+	return conn(ctx, s.db).Model(&model.Session{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"token":  token,
+		"expiry": expiry,
+	}).Error
+}
@@ -2,18 +2,27 @@ package repository
 
 import (
 	"a21hc3NpZ25tZW50/model"
-	"fmt"
+	"context"
+	"time"
 
 	"gorm.io/gorm"
 )
 
 type StudentRepository interface {
-	FetchAll() ([]model.Student, error)
-	FetchByID(id int) (*model.Student, error)
-	Store(s *model.Student) error
-	Update(id int, s *model.Student) error
-	Delete(id int) error
-	FetchWithClass() (*[]model.StudentClass, error)
+	FetchAll(ctx context.Context) ([]model.Student, error)
+	FetchByID(ctx context.Context, id int) (*model.Student, error)
+	Store(ctx context.Context, s *model.Student) error
+	Update(ctx context.Context, id int, s *model.Student, version int) error
+	Patch(ctx context.Context, id int, columns map[string]any, version int) error
+	Delete(ctx context.Context, id int) error
+	FetchWithClass(ctx context.Context) (*[]model.StudentClass, error)
+	FetchByClass(ctx context.Context, classID int) ([]model.Student, error)
+
+	FetchTrash(ctx context.Context, limit, offset int) ([]model.Student, error)
+	FetchDeletedByID(ctx context.Context, id int) (*model.Student, error)
+	Restore(ctx context.Context, id int) error
+	Purge(ctx context.Context, id int) error
+	PurgeDeletedBefore(ctx context.Context, cutoff time.Time) (int64, error)
 }
 
 type studentRepoImpl struct {
@@ -24,56 +33,133 @@ func NewStudentRepo(db *gorm.DB) *studentRepoImpl {
 	return &studentRepoImpl{db}
 }
 
-func (s *studentRepoImpl) FetchAll() ([]model.Student, error) {
+func (s *studentRepoImpl) FetchAll(ctx context.Context) ([]model.Student, error) {
 	var students []model.Student
-	err := s.db.Find(&students).Error
+	err := conn(ctx, s.db).Find(&students).Error
 	return students, err
 }
 
-func (s *studentRepoImpl) Store(student *model.Student) error {
-	err := s.db.Create(student).Error
-	return err
+func (s *studentRepoImpl) FetchByClass(ctx context.Context, classID int) ([]model.Student, error) {
+	var students []model.Student
+	err := conn(ctx, s.db).Where("class_id = ?", classID).Find(&students).Error
+	return students, err
+}
+
+func (s *studentRepoImpl) Store(ctx context.Context, student *model.Student) error {
+	student.Version = 1
+	return conn(ctx, s.db).Create(student).Error
+}
+
+// Update applies the non-zero fields of student if the row is still at
+// version, and moves it to the next version. It fails with ErrVersionMismatch
+// when someone else updated the student first.
+func (s *studentRepoImpl) Update(ctx context.Context, id int, student *model.Student, version int) error {
+	student.Version = version + 1
+	return s.updateAt(ctx, id, version, student)
 }
 
-func (s *studentRepoImpl) Update(id int, student *model.Student) error {
+// Patch is Update for a set of columns, which are written even when they
+// are zero.
+func (s *studentRepoImpl) Patch(ctx context.Context, id int, columns map[string]any, version int) error {
+	columns["version"] = version + 1
+	return s.updateAt(ctx, id, version, columns)
+}
+
+func (s *studentRepoImpl) updateAt(ctx context.Context, id int, version int, values any) error {
+	db := conn(ctx, s.db)
 	var students model.Student
-	err := s.db.Where("id = ?", id).First(&students).Error
+	err := db.Where("id = ?", id).First(&students).Error
 	if err != nil {
 		return err
 	}
-	err = s.db.Model(&students).Updates(student).Error
-	return err
+
+	result := db.Model(&students).Where("version = ?", version).Updates(values)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrVersionMismatch
+	}
+	return nil
 }
 
-func (s *studentRepoImpl) Delete(id int) error {
+func (s *studentRepoImpl) Delete(ctx context.Context, id int) error {
+	db := conn(ctx, s.db)
 	var student model.Student
-	err := s.db.Where("id = ?", id).First(&student).Error
+	err := db.Where("id = ?", id).First(&student).Error
 	if err != nil {
 		return err
 	}
 
-	err = s.db.Delete(&student).Error
+	err = db.Delete(&student).Error
 	return err
 }
 
-func (s *studentRepoImpl) FetchByID(id int) (*model.Student, error) {
+func (s *studentRepoImpl) FetchByID(ctx context.Context, id int) (*model.Student, error) {
 	var student model.Student
-	err := s.db.Where("id = ?", id).First(&student).Error
+	err := conn(ctx, s.db).Where("id = ?", id).First(&student).Error
 	if err != nil {
 		return nil, err
 	}
 	return &student, nil
 }
 
-func (s *studentRepoImpl) FetchWithClass() (*[]model.StudentClass, error) {
+func (s *studentRepoImpl) FetchWithClass(ctx context.Context) (*[]model.StudentClass, error) {
 	studentClass := make([]model.StudentClass, 0)
-	err := s.db.Table("students").
+	err := conn(ctx, s.db).Table("students").
 		Select("students.name, students.address, classes.name as class_name, classes.professor, classes.room_number").
 		Joins("left join classes on students.class_id = classes.id").
+		Where("students.deleted_at IS NULL").
 		Scan(&studentClass).Error
+	return &studentClass, err
+}
+
+// FetchTrash returns soft-deleted students, most recently deleted first.
+func (s *studentRepoImpl) FetchTrash(ctx context.Context, limit, offset int) ([]model.Student, error) {
+	students := []model.Student{}
+	err := conn(ctx, s.db).Unscoped().Where("deleted_at IS NOT NULL").
+		Order("deleted_at DESC").Limit(limit).Offset(offset).Find(&students).Error
+	return students, err
+}
+
+func (s *studentRepoImpl) FetchDeletedByID(ctx context.Context, id int) (*model.Student, error) {
+	var student model.Student
+	err := conn(ctx, s.db).Unscoped().Where("id = ? AND deleted_at IS NOT NULL", id).First(&student).Error
 	if err != nil {
-		fmt.Println(err)
-		return &studentClass, err
+		return nil, err
+	}
+	return &student, nil
+}
+
+// Restore brings a soft-deleted student back.
+func (s *studentRepoImpl) Restore(ctx context.Context, id int) error {
+	result := conn(ctx, s.db).Unscoped().Model(&model.Student{}).
+		Where("id = ? AND deleted_at IS NOT NULL", id).
+		Update("deleted_at", nil)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// Purge permanently deletes a student that is already in the trash.
+func (s *studentRepoImpl) Purge(ctx context.Context, id int) error {
+	result := conn(ctx, s.db).Unscoped().Where("id = ? AND deleted_at IS NOT NULL", id).Delete(&model.Student{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
 	}
-	return &studentClass, nil
+	return nil
+}
+
+// PurgeDeletedBefore permanently deletes the students soft-deleted before
+// cutoff and returns how many there were.
+func (s *studentRepoImpl) PurgeDeletedBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	result := conn(ctx, s.db).Unscoped().Where("deleted_at < ?", cutoff).Delete(&model.Student{})
+	return result.RowsAffected, result.Error
 }
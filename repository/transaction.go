@@ -0,0 +1,69 @@
+package repository
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+)
+
+// Transactor runs a unit of work in one database transaction. Every
+// repository call made with the ctx handed to fn joins that transaction.
+// Calling Transaction again inside fn opens a savepoint, so an inner unit of
+// work can fail and roll back on its own while the outer one carries on. The
+// transaction is rolled back when fn returns an error or panics, and the
+// panic is re-raised.
+type Transactor interface {
+	Transaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+type transactorImpl struct {
+	db *gorm.DB
+}
+
+func NewTransactor(db *gorm.DB) *transactorImpl {
+	return &transactorImpl{db}
+}
+
+type txKey struct{}
+
+type afterCommitKey struct{}
+
+func (t *transactorImpl) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	var hooks []func()
+	err := conn(ctx, t.db).Transaction(func(tx *gorm.DB) error {
+		txCtx := context.WithValue(ctx, txKey{}, tx)
+		return fn(context.WithValue(txCtx, afterCommitKey{}, &hooks))
+	})
+	if err != nil {
+		return err
+	}
+
+	// A savepoint is only durable once the outer transaction commits.
+	if outer, ok := ctx.Value(afterCommitKey{}).(*[]func()); ok {
+		*outer = append(*outer, hooks...)
+		return nil
+	}
+	for _, hook := range hooks {
+		hook()
+	}
+	return nil
+}
+
+// AfterCommit runs fn once the transaction open in ctx has committed, or right
+// away when there is none. fn is dropped if the transaction rolls back.
+func AfterCommit(ctx context.Context, fn func()) {
+	if hooks, ok := ctx.Value(afterCommitKey{}).(*[]func()); ok {
+		*hooks = append(*hooks, fn)
+		return
+	}
+	fn()
+}
+
+// conn returns the transaction open in ctx, or db when there is none, bound
+// to ctx.
+func conn(ctx context.Context, db *gorm.DB) *gorm.DB {
+	if tx, ok := ctx.Value(txKey{}).(*gorm.DB); ok {
+		return tx.WithContext(ctx)
+	}
+	return db.WithContext(ctx)
+}
@@ -0,0 +1,140 @@
+package repository
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type TwoFactorRepository interface {
+	Fetch(ctx context.Context, username string) (model.TwoFactor, error)
+	Save(ctx context.Context, twoFactor model.TwoFactor) error
+	Enable(ctx context.Context, username string, at time.Time, step int64, recoveryHashes []string) error
+	Delete(ctx context.Context, username string) error
+	AdvanceStep(ctx context.Context, username string, step int64) error
+	UseRecoveryCode(ctx context.Context, username string, hash string, at time.Time) error
+
+	AddChallenge(ctx context.Context, challenge *model.LoginChallenge) error
+	FetchChallenge(ctx context.Context, hash string, now time.Time) (model.LoginChallenge, error)
+	CountChallengeAttempt(ctx context.Context, id uint) (int, error)
+	DeleteChallenge(ctx context.Context, id uint) error
+	DeleteExpiredChallenges(ctx context.Context, username string, before time.Time) error
+}
+
+type twoFactorRepoImpl struct {
+	db *gorm.DB
+}
+
+func NewTwoFactorRepo(db *gorm.DB) *twoFactorRepoImpl {
+	return &twoFactorRepoImpl{db}
+}
+
+func (t *twoFactorRepoImpl) Fetch(ctx context.Context, username string) (model.TwoFactor, error) {
+	var twoFactor model.TwoFactor
+	err := conn(ctx, t.db).Where("username = ?", username).First(&twoFactor).Error
+	return twoFactor, err
+}
+
+func (t *twoFactorRepoImpl) Save(ctx context.Context, twoFactor model.TwoFactor) error {
+	return conn(ctx, t.db).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "username"}},
+		DoUpdates: clause.AssignmentColumns([]string{"secret", "enabled", "last_used_step", "enabled_at", "updated_at"}),
+	}).Create(&twoFactor).Error
+}
+
+// Enable activates the pending secret and replaces the user's recovery codes
+// in one transaction.
+func (t *twoFactorRepoImpl) Enable(ctx context.Context, username string, at time.Time, step int64, recoveryHashes []string) error {
+	return conn(ctx, t.db).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&model.TwoFactor{}).Where("username = ? AND NOT enabled", username).Updates(map[string]interface{}{
+			"enabled":        true,
+			"enabled_at":     at,
+			"last_used_step": step,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		if err := tx.Where("username = ?", username).Delete(&model.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		codes := make([]model.RecoveryCode, 0, len(recoveryHashes))
+		for _, hash := range recoveryHashes {
+			codes = append(codes, model.RecoveryCode{Username: username, Hash: hash})
+		}
+		return tx.Create(&codes).Error
+	})
+}
+
+func (t *twoFactorRepoImpl) Delete(ctx context.Context, username string) error {
+	return conn(ctx, t.db).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("username = ?", username).Delete(&model.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("username = ?", username).Delete(&model.TwoFactor{}).Error
+	})
+}
+
+// AdvanceStep records the time step of an accepted code. It fails with
+// gorm.ErrRecordNotFound when that step or a later one was already used, so a
+// code cannot be replayed.
+func (t *twoFactorRepoImpl) AdvanceStep(ctx context.Context, username string, step int64) error {
+	result := conn(ctx, t.db).Model(&model.TwoFactor{}).
+		Where("username = ? AND last_used_step < ?", username, step).
+		Update("last_used_step", step)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (t *twoFactorRepoImpl) UseRecoveryCode(ctx context.Context, username string, hash string, at time.Time) error {
+	result := conn(ctx, t.db).Model(&model.RecoveryCode{}).
+		Where("username = ? AND hash = ? AND used_at IS NULL", username, hash).
+		Update("used_at", at)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (t *twoFactorRepoImpl) AddChallenge(ctx context.Context, challenge *model.LoginChallenge) error {
+	return conn(ctx, t.db).Create(challenge).Error
+}
+
+func (t *twoFactorRepoImpl) FetchChallenge(ctx context.Context, hash string, now time.Time) (model.LoginChallenge, error) {
+	var challenge model.LoginChallenge
+	err := conn(ctx, t.db).Where("hash = ? AND expires_at > ?", hash, now).First(&challenge).Error
+	return challenge, err
+}
+
+// CountChallengeAttempt increments and returns the number of codes tried
+// against a challenge.
+func (t *twoFactorRepoImpl) CountChallengeAttempt(ctx context.Context, id uint) (int, error) {
+	var challenge model.LoginChallenge
+	err := conn(ctx, t.db).Model(&challenge).
+		Clauses(clause.Returning{Columns: []clause.Column{{Name: "attempts"}}}).
+		Where("id = ?", id).
+		Update("attempts", gorm.Expr("attempts + 1")).Error
+	return challenge.Attempts, err
+}
+
+func (t *twoFactorRepoImpl) DeleteChallenge(ctx context.Context, id uint) error {
+	return conn(ctx, t.db).Delete(&model.LoginChallenge{}, id).Error
+}
+
+func (t *twoFactorRepoImpl) DeleteExpiredChallenges(ctx context.Context, username string, before time.Time) error {
+	return conn(ctx, t.db).Where("username = ? AND expires_at <= ?", username, before).Delete(&model.LoginChallenge{}).Error
+}
@@ -2,13 +2,23 @@ package repository
 
 import (
 	"a21hc3NpZ25tZW50/model"
+	"context"
+	"time"
 
 	"gorm.io/gorm"
 )
 
 type UserRepository interface {
-	Add(user model.User) error
-	CheckAvail(user model.User) error
+	Add(ctx context.Context, user model.User) error
+	CheckAvail(ctx context.Context, user model.User) error
+	FetchByUsername(ctx context.Context, username string) (model.User, error)
+	UpdateRole(ctx context.Context, username string, role string) error
+	UpdatePassword(ctx context.Context, username string, password string) error
+	UpdateProfile(ctx context.Context, username string, update model.ProfileUpdate) error
+	UpdateLastLogin(ctx context.Context, username string, at time.Time) error
+	SetDisabled(ctx context.Context, username string, disabled bool) error
+	FetchAll(ctx context.Context, limit, offset int) ([]model.User, error)
+	Delete(ctx context.Context, username string) error
 }
 
 type userRepository struct {
@@ -18,10 +28,94 @@ type userRepository struct {
 func NewUserRepo(db *gorm.DB) *userRepository {
 	return &userRepository{db}
 }
-func (u *userRepository) Add(user model.User) error {
-	return u.db.Create(&user).Error
+func (u *userRepository) Add(ctx context.Context, user model.User) error {
+	return conn(ctx, u.db).Create(&user).Error
 }
 
-func (u *userRepository) CheckAvail(user model.User) error {
-	return u.db.Where("username = ?", user.Username).First(&model.User{}).Error
+func (u *userRepository) CheckAvail(ctx context.Context, user model.User) error {
+	return conn(ctx, u.db).Where("username = ?", user.Username).First(&model.User{}).Error
+}
+
+func (u *userRepository) FetchByUsername(ctx context.Context, username string) (model.User, error) {
+	var user model.User
+	err := conn(ctx, u.db).Where("username = ?", username).First(&user).Error
+	return user, err
+}
+
+func (u *userRepository) UpdateRole(ctx context.Context, username string, role string) error {
+	result := conn(ctx, u.db).Model(&model.User{}).Where("username = ?", username).Update("role", role)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (u *userRepository) UpdatePassword(ctx context.Context, username string, password string) error {
+	result := conn(ctx, u.db).Model(&model.User{}).Where("username = ?", username).Update("password", password)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (u *userRepository) UpdateProfile(ctx context.Context, username string, update model.ProfileUpdate) error {
+	updates := map[string]interface{}{}
+	if update.DisplayName != nil {
+		updates["display_name"] = *update.DisplayName
+	}
+	if update.Email != nil {
+		updates["email"] = *update.Email
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+
+	result := conn(ctx, u.db).Model(&model.User{}).Where("username = ?", username).Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (u *userRepository) UpdateLastLogin(ctx context.Context, username string, at time.Time) error {
+	return conn(ctx, u.db).Model(&model.User{}).Where("username = ?", username).Update("last_login_at", at).Error
+}
+
+func (u *userRepository) SetDisabled(ctx context.Context, username string, disabled bool) error {
+	result := conn(ctx, u.db).Model(&model.User{}).Where("username = ?", username).Update("disabled", disabled)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (u *userRepository) FetchAll(ctx context.Context, limit, offset int) ([]model.User, error) {
+	var users []model.User
+	err := conn(ctx, u.db).Order("id").Limit(limit).Offset(offset).Find(&users).Error
+	return users, err
+}
+
+// Delete removes the user row for good, so the username can be registered
+// again.
+func (u *userRepository) Delete(ctx context.Context, username string) error {
+	result := conn(ctx, u.db).Unscoped().Where("username = ?", username).Delete(&model.User{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
 }
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"a21hc3NpZ25tZW50/repository"
+	"context"
+	"encoding/json"
+	"reflect"
+)
+
+type AuditService interface {
+	Record(ctx context.Context, event model.AuditEvent, before, after any) error
+	List(ctx context.Context, filter model.AuditFilter, limit, offset int) ([]model.AuditEvent, error)
+}
+
+type auditService struct {
+	auditRepository repository.AuditRepository
+}
+
+func NewAuditService(auditRepository repository.AuditRepository) AuditService {
+	return &auditService{auditRepository}
+}
+
+// Record appends event to the audit log. The actor comes from the principal
+// in ctx unless the event already names one, the request ID and IP from the
+// request info. before and after are reduced to the fields that differ.
+func (s *auditService) Record(ctx context.Context, event model.AuditEvent, before, after any) error {
+	ctx, span := startSpan(ctx, "AuditService.Record")
+	defer span.End()
+
+	if principal, ok := model.PrincipalFrom(ctx); ok && event.Actor == "" {
+		event.Actor = principal.Username
+	}
+	if info, ok := model.RequestInfoFrom(ctx); ok {
+		event.RequestID = info.ID
+		event.IP = info.IP
+	}
+
+	var err error
+	event.Before, event.After, err = auditDiff(before, after)
+	if err != nil {
+		return err
+	}
+
+	return s.auditRepository.Add(ctx, &event)
+}
+
+func (s *auditService) List(ctx context.Context, filter model.AuditFilter, limit, offset int) ([]model.AuditEvent, error) {
+	ctx, span := startSpan(ctx, "AuditService.List")
+	defer span.End()
+
+	if _, err := authorize(ctx, model.ScopeAccount, model.RoleAdmin); err != nil {
+		return nil, err
+	}
+	return s.auditRepository.Fetch(ctx, filter, limit, offset)
+}
+
+// auditDiff flattens before and after to their JSON fields and drops the ones
+// that are equal on both sides. A nil side stays nil, so a creation keeps
+// every field of after and a deletion every field of before.
+func auditDiff(before, after any) (map[string]any, map[string]any, error) {
+	beforeFields, err := auditFields(before)
+	if err != nil {
+		return nil, nil, err
+	}
+	afterFields, err := auditFields(after)
+	if err != nil {
+		return nil, nil, err
+	}
+	if beforeFields == nil || afterFields == nil {
+		return beforeFields, afterFields, nil
+	}
+
+	for key, value := range beforeFields {
+		if other, ok := afterFields[key]; ok && reflect.DeepEqual(value, other) {
+			delete(beforeFields, key)
+			delete(afterFields, key)
+		}
+	}
+	return beforeFields, afterFields, nil
+}
+
+func auditFields(value any) (map[string]any, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]any
+	err = json.Unmarshal(encoded, &fields)
+	return fields, err
+}
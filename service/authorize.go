@@ -0,0 +1,25 @@
+package service
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"context"
+	"errors"
+)
+
+var (
+	ErrUnauthenticated = errors.New("Unauthenticated")
+	ErrForbidden       = errors.New("Forbidden")
+)
+
+// authorize returns the caller the api layer stored in ctx, provided they
+// hold scope and, when role is not empty, that role.
+func authorize(ctx context.Context, scope string, role string) (model.Principal, error) {
+	principal, ok := model.PrincipalFrom(ctx)
+	if !ok {
+		return model.Principal{}, ErrUnauthenticated
+	}
+	if !principal.HasScope(scope) || role != "" && !principal.HasRole(role) {
+		return model.Principal{}, ErrForbidden
+	}
+	return principal, nil
+}
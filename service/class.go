@@ -3,10 +3,11 @@ package service
 import (
 	"a21hc3NpZ25tZW50/model"
 	"a21hc3NpZ25tZW50/repository"
+	"context"
 )
 
 type ClassService interface {
-	FetchAll() ([]model.Class, error)
+	FetchAll(ctx context.Context) ([]model.Class, error)
 }
 
 type classService struct {
@@ -17,8 +18,11 @@ func NewClassService(classRepository repository.ClassRepository) ClassService {
 	return &classService{classRepository}
 }
 
-func (s *classService) FetchAll() ([]model.Class, error) {
-	classes, err := s.classRepository.FetchAll()
+func (s *classService) FetchAll(ctx context.Context) ([]model.Class, error) {
+	ctx, span := startSpan(ctx, "ClassService.FetchAll")
+	defer span.End()
+
+	classes, err := s.classRepository.FetchAll(ctx)
 	if err != nil {
 		return nil, err
 	}
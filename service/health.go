@@ -0,0 +1,89 @@
+package service
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"a21hc3NpZ25tZW50/repository"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type HealthService interface {
+	Ready(ctx context.Context) model.Readiness
+}
+
+type healthService struct {
+	healthRepository repository.HealthRepository
+	config           model.HealthConfig
+}
+
+func NewHealthService(healthRepository repository.HealthRepository, config model.HealthConfig) HealthService {
+	if config.Timeout <= 0 {
+		config.Timeout = 2 * time.Second
+	}
+	return &healthService{healthRepository, config}
+}
+
+// Ready runs every readiness check, each bounded by the configured timeout,
+// and reports ready only when all of them pass.
+func (s *healthService) Ready(ctx context.Context) model.Readiness {
+	readiness := model.Readiness{Status: model.HealthReady}
+	checks := []struct {
+		name string
+		run  func(context.Context) error
+	}{
+		{"database", s.healthRepository.Ping},
+		{"migrations", s.checkMigrations},
+		{"classes", s.checkClasses},
+	}
+
+	for _, check := range checks {
+		result := s.run(ctx, check.name, check.run)
+		if result.Status != model.HealthOK {
+			readiness.Status = model.HealthNotReady
+		}
+		readiness.Checks = append(readiness.Checks, result)
+	}
+	return readiness
+}
+
+func (s *healthService) run(ctx context.Context, name string, check func(context.Context) error) model.HealthCheck {
+	ctx, cancel := context.WithTimeout(ctx, s.config.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check(ctx)
+	result := model.HealthCheck{
+		Name:      name,
+		Status:    model.HealthOK,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		result.Status = model.HealthFailing
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func (s *healthService) checkMigrations(ctx context.Context) error {
+	missing, err := s.healthRepository.MissingSchema(ctx, s.config.Models)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("pending migrations: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (s *healthService) checkClasses(ctx context.Context) error {
+	missing, err := s.healthRepository.MissingClasses(ctx, s.config.Classes)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing default classes: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package service
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"a21hc3NpZ25tZW50/repository"
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// LoginGuard throttles password guessing. Failed logins are counted per
+// username and per client IP in the login_attempts table, so every server
+// instance sees the same counters. Once a counter reaches its threshold the
+// username or IP is locked out with an exponentially growing delay.
+type LoginGuard interface {
+	Check(ctx context.Context, username, ip string) (time.Duration, error)
+	RecordFailure(ctx context.Context, username, ip string) (time.Duration, error)
+	RecordSuccess(ctx context.Context, username string) error
+	Unlock(ctx context.Context, username string) error
+}
+
+type loginGuard struct {
+	loginAttemptRepository repository.LoginAttemptRepository
+	config                 model.LockoutConfig
+}
+
+func NewLoginGuard(loginAttemptRepository repository.LoginAttemptRepository, config model.LockoutConfig) LoginGuard {
+	if config.UserThreshold <= 0 {
+		config.UserThreshold = 5
+	}
+	if config.IPThreshold <= 0 {
+		config.IPThreshold = 20
+	}
+	if config.Window <= 0 {
+		config.Window = 15 * time.Minute
+	}
+	if config.BaseDelay <= 0 {
+		config.BaseDelay = 30 * time.Second
+	}
+	if config.MaxDelay <= 0 {
+		config.MaxDelay = time.Hour
+	}
+	return &loginGuard{loginAttemptRepository, config}
+}
+
+// Check returns how long the caller must wait before trying again, or zero
+// when neither the username nor the IP is locked.
+func (g *loginGuard) Check(ctx context.Context, username, ip string) (time.Duration, error) {
+	ctx, span := startSpan(ctx, "LoginGuard.Check")
+	defer span.End()
+
+	now := time.Now()
+
+	var wait time.Duration
+	for _, key := range [][2]string{{g.kind(model.LoginAttemptUser), username}, {g.kind(model.LoginAttemptIP), ip}} {
+		remaining, err := g.lockedFor(ctx, key[0], key[1], now)
+		if err != nil {
+			return 0, err
+		}
+		if remaining > wait {
+			wait = remaining
+		}
+	}
+
+	return wait, nil
+}
+
+// RecordFailure counts a failed login and returns the lockout it triggered,
+// if any.
+func (g *loginGuard) RecordFailure(ctx context.Context, username, ip string) (time.Duration, error) {
+	ctx, span := startSpan(ctx, "LoginGuard.RecordFailure")
+	defer span.End()
+
+	now := time.Now()
+
+	var wait time.Duration
+	for _, key := range []struct {
+		kind, key string
+		threshold int
+	}{
+		{g.kind(model.LoginAttemptUser), username, g.config.UserThreshold},
+		{g.kind(model.LoginAttemptIP), ip, g.config.IPThreshold},
+	} {
+		delay, err := g.record(ctx, key.kind, key.key, key.threshold, now)
+		if err != nil {
+			return 0, err
+		}
+		if delay > wait {
+			wait = delay
+		}
+	}
+
+	return wait, nil
+}
+
+// RecordSuccess clears the username's failure streak. The IP counter is left
+// alone so that one valid account can't be used to reset it.
+func (g *loginGuard) RecordSuccess(ctx context.Context, username string) error {
+	ctx, span := startSpan(ctx, "LoginGuard.RecordSuccess")
+	defer span.End()
+
+	return g.loginAttemptRepository.Reset(ctx, g.kind(model.LoginAttemptUser), username)
+}
+
+func (g *loginGuard) Unlock(ctx context.Context, username string) error {
+	ctx, span := startSpan(ctx, "LoginGuard.Unlock")
+	defer span.End()
+
+	return g.loginAttemptRepository.Reset(ctx, g.kind(model.LoginAttemptUser), username)
+}
+
+// lockedFor returns how long the key is still locked, or zero.
+func (g *loginGuard) lockedFor(ctx context.Context, kind, key string, now time.Time) (time.Duration, error) {
+	attempt, err := g.loginAttemptRepository.Fetch(ctx, kind, key)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return max(attempt.LockedUntil.Sub(now), 0), nil
+}
+
+// record counts a failure against the key and locks it once threshold is
+// reached, returning the lockout it triggered, if any.
+func (g *loginGuard) record(ctx context.Context, kind, key string, threshold int, now time.Time) (time.Duration, error) {
+	attempt, err := g.loginAttemptRepository.RecordFailure(ctx, kind, key, now, g.config.Window)
+	if err != nil {
+		return 0, err
+	}
+	if attempt.Failures < threshold {
+		return 0, nil
+	}
+
+	delay := g.lockoutDelay(attempt.Failures - threshold)
+	if err := g.loginAttemptRepository.Lock(ctx, kind, key, now.Add(delay)); err != nil {
+		return 0, err
+	}
+	return delay, nil
+}
+
+func (g *loginGuard) kind(kind string) string {
+	return g.config.KindPrefix + kind
+}
+
+// lockoutDelay doubles BaseDelay for every failure past the threshold, up to
+// MaxDelay.
+func (g *loginGuard) lockoutDelay(excess int) time.Duration {
+	delay := g.config.BaseDelay
+	for i := 0; i < excess && delay < g.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > g.config.MaxDelay {
+		delay = g.config.MaxDelay
+	}
+	return delay
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Notifier delivers out-of-band messages to users. Production deployments
+// plug in an email or SMS sender; the writer notifier is meant for local
+// development and tests.
+type Notifier interface {
+	SendPasswordReset(username string, token string, expiresAt time.Time) error
+}
+
+type writerNotifier struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterNotifier writes each notification to w as a line of JSON.
+func NewWriterNotifier(w io.Writer) Notifier {
+	return &writerNotifier{w: w}
+}
+
+func (n *writerNotifier) SendPasswordReset(username string, token string, expiresAt time.Time) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return json.NewEncoder(n.w).Encode(map[string]interface{}{
+		"type":       "password_reset",
+		"username":   username,
+		"token":      token,
+		"expires_at": expiresAt,
+	})
+}
+
+type discardNotifier struct {
+	logger *slog.Logger
+}
+
+// NewDiscardNotifier delivers nothing. It logs that a notification was
+// dropped, without its token, so a missing sender shows up in the logs.
+func NewDiscardNotifier(logger *slog.Logger) Notifier {
+	return &discardNotifier{logger}
+}
+
+func (n *discardNotifier) SendPasswordReset(username string, token string, expiresAt time.Time) error {
+	n.logger.Warn("password reset requested but no notifier is configured; nothing was sent", "username", username)
+	return nil
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	_ "embed"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//go:embed common_passwords.txt
+var commonPasswords string
+
+type PasswordPolicy interface {
+	Validate(username string, password string) error
+}
+
+// PasswordPolicyError lists every rule a password broke, so callers can
+// report them all at once instead of one per attempt.
+type PasswordPolicyError struct {
+	Violations []string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return "password does not meet the policy: " + strings.Join(e.Violations, "; ")
+}
+
+type passwordPolicy struct {
+	config    model.PasswordPolicyConfig
+	blocklist map[string]bool
+}
+
+func NewPasswordPolicy(config model.PasswordPolicyConfig) PasswordPolicy {
+	if config.MinLength <= 0 {
+		config.MinLength = 8
+	}
+	if config.MinCharClasses > 4 {
+		config.MinCharClasses = 4
+	}
+
+	blocklist := map[string]bool{}
+	for _, word := range strings.Split(commonPasswords, "\n") {
+		if word = strings.TrimSpace(word); word != "" {
+			blocklist[strings.ToLower(word)] = true
+		}
+	}
+	for _, word := range config.Blocklist {
+		if word = strings.TrimSpace(word); word != "" {
+			blocklist[strings.ToLower(word)] = true
+		}
+	}
+
+	return &passwordPolicy{config: config, blocklist: blocklist}
+}
+
+func (p *passwordPolicy) Validate(username string, password string) error {
+	var violations []string
+
+	if utf8.RuneCountInString(password) < p.config.MinLength {
+		violations = append(violations, fmt.Sprintf("must be at least %d characters long", p.config.MinLength))
+	}
+
+	if classes := charClasses(password); classes < p.config.MinCharClasses {
+		violations = append(violations, fmt.Sprintf("must mix at least %d of lowercase letters, uppercase letters, digits and symbols", p.config.MinCharClasses))
+	}
+
+	if p.blocklist[strings.ToLower(password)] {
+		violations = append(violations, "is too common")
+	}
+
+	if p.config.DisallowUsername && len(username) >= 3 && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		violations = append(violations, "must not contain the username")
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+func charClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = 1
+		case unicode.IsUpper(c):
+			upper = 1
+		case unicode.IsDigit(c):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
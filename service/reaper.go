@@ -0,0 +1,133 @@
+package service
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"a21hc3NpZ25tZW50/repository"
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type SessionReaper interface {
+	Start()
+	Stop()
+	RunOnce(ctx context.Context) (model.ReaperStats, error)
+	Stats() model.ReaperStats
+}
+
+type sessionReaper struct {
+	sessionRepository repository.SessionsRepository
+	config            model.ReaperConfig
+
+	mu     sync.Mutex
+	stats  model.ReaperStats
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewSessionReaper(sessionRepository repository.SessionsRepository, config model.ReaperConfig) SessionReaper {
+	if config.Interval <= 0 {
+		config.Interval = 10 * time.Minute
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 500
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	return &sessionReaper{sessionRepository: sessionRepository, config: config}
+}
+
+// Start runs the reaper in the background right away and then every
+// configured interval until Stop is called.
+func (s *sessionReaper) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(s.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			s.run(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (s *sessionReaper) run(ctx context.Context) {
+	stats, err := s.RunOnce(ctx)
+	if err != nil {
+		s.config.Logger.Error("session reaper failed", "err", err)
+		return
+	}
+	if stats.Deleted > 0 {
+		s.config.Logger.Info("session reaper deleted expired sessions", "deleted", stats.Deleted, "batches", stats.Batches)
+	}
+}
+
+// Stop signals the background loop to exit, cancelling any run in flight, and
+// waits for it to return.
+func (s *sessionReaper) Stop() {
+	if s.cancel == nil {
+		return
+	}
+	s.cancel()
+	<-s.done
+}
+
+// RunOnce deletes expired sessions batch by batch until a batch comes back
+// short, then counts the sessions still active, and records the result as the
+// last-run stats.
+func (s *sessionReaper) RunOnce(ctx context.Context) (model.ReaperStats, error) {
+	start := time.Now()
+	stats := model.ReaperStats{LastRunAt: start}
+
+	var err error
+	for {
+		var deleted int64
+		deleted, err = s.sessionRepository.DeleteExpired(ctx, start, s.config.BatchSize)
+		if err != nil {
+			stats.Error = err.Error()
+			break
+		}
+
+		stats.Batches++
+		stats.Deleted += deleted
+		if deleted < int64(s.config.BatchSize) {
+			break
+		}
+	}
+	if err == nil {
+		var createdAfter time.Time
+		if s.config.MaxLifetime > 0 {
+			createdAfter = start.Add(-s.config.MaxLifetime)
+		}
+		stats.Active, err = s.sessionRepository.CountActive(ctx, start, createdAfter)
+		if err != nil {
+			stats.Error = err.Error()
+		}
+	}
+	stats.DurationMs = time.Since(start).Milliseconds()
+
+	s.mu.Lock()
+	s.stats = stats
+	s.mu.Unlock()
+
+	return stats, err
+}
+
+func (s *sessionReaper) Stats() model.ReaperStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
@@ -0,0 +1,52 @@
+package service
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"a21hc3NpZ25tZW50/repository"
+	"context"
+	"time"
+)
+
+// ResetGuard throttles password reset requests. Only the client IP is ever
+// locked out. The per-username count merely caps how many reset
+// notifications a user gets within the window, so flooding requests for
+// someone else's username can't stop the owner from asking for a reset.
+type ResetGuard interface {
+	Check(ctx context.Context, ip string) (time.Duration, error)
+	// Record counts a request and reports whether a notification may still
+	// be sent for username.
+	Record(ctx context.Context, username, ip string) (bool, error)
+}
+
+type resetGuard struct {
+	guard *loginGuard
+}
+
+// NewResetGuard uses config.IPThreshold for the IP lockout and
+// config.UserThreshold as the notification cap.
+func NewResetGuard(loginAttemptRepository repository.LoginAttemptRepository, config model.LockoutConfig) ResetGuard {
+	return &resetGuard{NewLoginGuard(loginAttemptRepository, config).(*loginGuard)}
+}
+
+func (g *resetGuard) Check(ctx context.Context, ip string) (time.Duration, error) {
+	ctx, span := startSpan(ctx, "ResetGuard.Check")
+	defer span.End()
+
+	return g.guard.lockedFor(ctx, g.guard.kind(model.LoginAttemptIP), ip, time.Now())
+}
+
+func (g *resetGuard) Record(ctx context.Context, username, ip string) (bool, error) {
+	ctx, span := startSpan(ctx, "ResetGuard.Record")
+	defer span.End()
+
+	now := time.Now()
+	if _, err := g.guard.record(ctx, g.guard.kind(model.LoginAttemptIP), ip, g.guard.config.IPThreshold, now); err != nil {
+		return false, err
+	}
+
+	attempt, err := g.guard.loginAttemptRepository.RecordFailure(ctx, g.guard.kind(model.LoginAttemptUser), username, now, g.guard.config.Window)
+	if err != nil {
+		return false, err
+	}
+	return attempt.Failures <= g.guard.config.UserThreshold, nil
+}
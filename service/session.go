@@ -3,59 +3,217 @@ package service
 import (
 	"a21hc3NpZ25tZW50/model"
 	"a21hc3NpZ25tZW50/repository"
+	"context"
 	"fmt"
 	"time"
+
+	"github.com/google/uuid"
 )
 
 type SessionService interface {
-	AddSession(session model.Session) error
-	UpdateSession(session model.Session) error
-	DeleteSession(sessionToken string) error
-	SessionAvailName(username string) error
-	TokenExpired(session model.Session) bool
-	TokenValidity(token string) (model.Session, error)
+	AddSession(ctx context.Context, session model.Session) error
+	DeleteSession(ctx context.Context, sessionToken string) error
+	TokenValidity(ctx context.Context, token string) (model.Session, error)
+
+	CreateSession(ctx context.Context, session model.Session) (model.Session, error)
+	ExtendSession(ctx context.Context, session model.Session) (model.Session, bool, error)
+	RotateSession(ctx context.Context, token string) (model.Session, error)
+	ListSessions(ctx context.Context, username string) ([]model.Session, error)
+	RevokeSession(ctx context.Context, username string, id uint) error
+	RevokeAllSessions(ctx context.Context, username string) error
+	RevokeOtherSessions(ctx context.Context, username string, keepID uint) error
 }
 
 type sessionService struct {
 	sessionRepository repository.SessionsRepository
+	config            model.SessionConfig
 }
 
-func NewSessionService(sessionRepository repository.SessionsRepository) SessionService {
-	return &sessionService{sessionRepository}
+func NewSessionService(sessionRepository repository.SessionsRepository, config model.SessionConfig) SessionService {
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = 5 * time.Hour
+	}
+	return &sessionService{sessionRepository, config}
 }
 
-func (s *sessionService) SessionAvailName(username string) error {
-	return s.sessionRepository.SessionAvailName(username)
+func (s *sessionService) AddSession(ctx context.Context, session model.Session) error {
+	ctx, span := startSpan(ctx, "SessionService.AddSession")
+	defer span.End()
+
+	return s.sessionRepository.AddSessions(ctx, session)
 }
 
-func (s *sessionService) AddSession(session model.Session) error {
-	return s.sessionRepository.AddSessions(session)
+func (s *sessionService) DeleteSession(ctx context.Context, sessionToken string) error {
+	ctx, span := startSpan(ctx, "SessionService.DeleteSession")
+	defer span.End()
+
+	return s.sessionRepository.DeleteSession(ctx, sessionToken)
 }
 
-func (s *sessionService) UpdateSession(session model.Session) error {
-	return s.sessionRepository.UpdateSessions(session)
+func (s *sessionService) TokenValidity(ctx context.Context, token string) (model.Session, error) {
+	ctx, span := startSpan(ctx, "SessionService.TokenValidity")
+	defer span.End()
+
+	session, err := s.sessionRepository.SessionAvailToken(ctx, token)
+	if err != nil {
+		return model.Session{}, err
+	}
+
+	if s.tokenExpired(session) {
+		if err := s.sessionRepository.DeleteSession(ctx, token); err != nil {
+			return model.Session{}, err
+		}
+		return model.Session{}, fmt.Errorf("Token is Expired!")
+	}
+
+	return session, nil
 }
 
-func (s *sessionService) DeleteSession(sessionToken string) error {
-	return s.sessionRepository.DeleteSession(sessionToken)
+func (s *sessionService) tokenExpired(session model.Session) bool {
+	now := time.Now()
+	if s.config.MaxLifetime > 0 && session.CreatedAt.Add(s.config.MaxLifetime).Before(now) {
+		return true
+	}
+	return session.Expiry.Before(now)
 }
 
-func (s *sessionService) TokenValidity(token string) (model.Session, error) {
-	session, err := s.sessionRepository.SessionAvailToken(token)
+// CreateSession stores a new session next to the user's existing ones. When
+// the user is over the configured maximum, the oldest sessions are revoked.
+func (s *sessionService) CreateSession(ctx context.Context, session model.Session) (model.Session, error) {
+	ctx, span := startSpan(ctx, "SessionService.CreateSession")
+	defer span.End()
+
+	if session.Expiry.IsZero() {
+		session.Expiry = time.Now().Add(s.config.IdleTimeout)
+	}
+
+	if err := s.sessionRepository.AddSessions(ctx, session); err != nil {
+		return model.Session{}, err
+	}
+
+	session, err := s.sessionRepository.SessionAvailToken(ctx, session.Token)
+	if err != nil {
+		return model.Session{}, err
+	}
+
+	if s.config.MaxActive <= 0 {
+		return session, nil
+	}
+
+	sessions, err := s.ListSessions(ctx, session.Username)
 	if err != nil {
 		return model.Session{}, err
 	}
 
-	if s.TokenExpired(session) {
-		if err := s.sessionRepository.DeleteSession(token); err != nil {
+	for i := s.config.MaxActive; i < len(sessions); i++ {
+		if err := s.sessionRepository.DeleteByID(ctx, session.Username, sessions[i].ID); err != nil {
 			return model.Session{}, err
 		}
+	}
+
+	return session, nil
+}
+
+// ExtendSession slides the expiry of an active session forward by the idle
+// timeout. To avoid a write on every request the expiry is only moved once
+// RefreshThrottle has passed since the last extension, and never beyond the
+// session's absolute MaxLifetime. It reports whether the expiry changed.
+func (s *sessionService) ExtendSession(ctx context.Context, session model.Session) (model.Session, bool, error) {
+	ctx, span := startSpan(ctx, "SessionService.ExtendSession")
+	defer span.End()
+
+	now := time.Now()
+	lastExtended := session.Expiry.Add(-s.config.IdleTimeout)
+	if now.Sub(lastExtended) < s.config.RefreshThrottle {
+		return session, false, nil
+	}
+
+	expiry := s.slidingExpiry(session, now)
+	if !expiry.After(session.Expiry) {
+		return session, false, nil
+	}
+
+	if err := s.sessionRepository.UpdateExpiry(ctx, session.ID, expiry); err != nil {
+		return model.Session{}, false, err
+	}
+
+	session.Expiry = expiry
+	return session, true, nil
+}
+
+// RotateSession replaces the token of a valid session with a fresh one and
+// resets its idle expiry, keeping the original absolute lifetime.
+func (s *sessionService) RotateSession(ctx context.Context, token string) (model.Session, error) {
+	ctx, span := startSpan(ctx, "SessionService.RotateSession")
+	defer span.End()
+
+	session, err := s.TokenValidity(ctx, token)
+	if err != nil {
+		return model.Session{}, err
+	}
+
+	now := time.Now()
+	expiry := s.slidingExpiry(session, now)
+	if !expiry.After(now) {
 		return model.Session{}, fmt.Errorf("Token is Expired!")
 	}
 
+	session.Token = uuid.NewString()
+	session.Expiry = expiry
+	if err := s.sessionRepository.RotateToken(ctx, session.ID, session.Token, session.Expiry); err != nil {
+		return model.Session{}, err
+	}
+
 	return session, nil
 }
 
-func (s *sessionService) TokenExpired(session model.Session) bool {
-	return session.Expiry.Before(time.Now())
+func (s *sessionService) slidingExpiry(session model.Session, now time.Time) time.Time {
+	expiry := now.Add(s.config.IdleTimeout)
+	if s.config.MaxLifetime > 0 {
+		deadline := session.CreatedAt.Add(s.config.MaxLifetime)
+		if expiry.After(deadline) {
+			expiry = deadline
+		}
+	}
+	return expiry
+}
+
+func (s *sessionService) ListSessions(ctx context.Context, username string) ([]model.Session, error) {
+	ctx, span := startSpan(ctx, "SessionService.ListSessions")
+	defer span.End()
+
+	sessions, err := s.sessionRepository.FetchByUsername(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	active := make([]model.Session, 0, len(sessions))
+	for _, session := range sessions {
+		if !s.tokenExpired(session) {
+			active = append(active, session)
+		}
+	}
+
+	return active, nil
+}
+
+func (s *sessionService) RevokeSession(ctx context.Context, username string, id uint) error {
+	ctx, span := startSpan(ctx, "SessionService.RevokeSession")
+	defer span.End()
+
+	return s.sessionRepository.DeleteByID(ctx, username, id)
+}
+
+func (s *sessionService) RevokeAllSessions(ctx context.Context, username string) error {
+	ctx, span := startSpan(ctx, "SessionService.RevokeAllSessions")
+	defer span.End()
+
+	return s.sessionRepository.DeleteByUsername(ctx, username)
+}
+
+func (s *sessionService) RevokeOtherSessions(ctx context.Context, username string, keepID uint) error {
+	ctx, span := startSpan(ctx, "SessionService.RevokeOtherSessions")
+	defer span.End()
+
+	return s.sessionRepository.DeleteOthers(ctx, username, keepID)
 }
@@ -3,27 +3,58 @@ package service
 import (
 	"a21hc3NpZ25tZW50/model"
 	"a21hc3NpZ25tZW50/repository"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
 )
 
+var (
+	ErrStudentChanged = errors.New("The student was changed by someone else")
+	ErrInvalidPatch   = errors.New("Invalid patch")
+)
+
+// AnyVersion passed as the version to Update or Patch skips the version check,
+// like "If-Match: *".
+const AnyVersion = -1
+
 type StudentService interface {
-	FetchAll() ([]model.Student, error)
-	FetchByID(id int) (*model.Student, error)
-	Store(s *model.Student) error
-	Update(id int, s *model.Student) error
-	Delete(id int) error
-	FetchWithClass() (*[]model.StudentClass, error)
+	FetchAll(ctx context.Context) ([]model.Student, error)
+	FetchByID(ctx context.Context, id int) (*model.Student, error)
+	Store(ctx context.Context, s *model.Student) error
+	Update(ctx context.Context, id int, s *model.Student, version int) (*model.Student, error)
+	Patch(ctx context.Context, id int, patch model.StudentPatch, version int) (*model.Student, error)
+	Delete(ctx context.Context, id int) error
+	FetchWithClass(ctx context.Context) (*[]model.StudentClass, error)
+	FetchByClass(ctx context.Context, classID int) ([]model.Student, error)
+
+	Trash(ctx context.Context, limit, offset int) ([]model.Student, error)
+	Restore(ctx context.Context, id int) (*model.Student, error)
+	Purge(ctx context.Context, id int) error
+	PurgeTrash(ctx context.Context, olderThan time.Duration) (int64, error)
 }
 
 type studentService struct {
 	studentRepository repository.StudentRepository
+	auditService      AuditService
+	transactor        repository.Transactor
+	config            model.StudentConfig
 }
 
-func NewStudentService(studentRepository repository.StudentRepository) StudentService {
-	return &studentService{studentRepository}
+func NewStudentService(studentRepository repository.StudentRepository, auditService AuditService, transactor repository.Transactor, config model.StudentConfig) StudentService {
+	if config.TrashRetention <= 0 {
+		config.TrashRetention = 30 * 24 * time.Hour
+	}
+	return &studentService{studentRepository, auditService, transactor, config}
 }
 
-func (s *studentService) FetchAll() ([]model.Student, error) {
-	students, err := s.studentRepository.FetchAll()
+func (s *studentService) FetchAll(ctx context.Context) ([]model.Student, error) {
+	ctx, span := startSpan(ctx, "StudentService.FetchAll")
+	defer span.End()
+
+	students, err := s.studentRepository.FetchAll(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -31,8 +62,11 @@ func (s *studentService) FetchAll() ([]model.Student, error) {
 	return students, nil
 }
 
-func (s *studentService) FetchByID(id int) (*model.Student, error) {
-	student, err := s.studentRepository.FetchByID(id)
+func (s *studentService) FetchByID(ctx context.Context, id int) (*model.Student, error) {
+	ctx, span := startSpan(ctx, "StudentService.FetchByID")
+	defer span.End()
+
+	student, err := s.studentRepository.FetchByID(ctx, id)
 	if err != nil {
 		return nil, err
 	}
@@ -40,35 +74,136 @@ func (s *studentService) FetchByID(id int) (*model.Student, error) {
 	return student, nil
 }
 
-func (s *studentService) Store(student *model.Student) error {
-	err := s.studentRepository.Store(student)
-	if err != nil {
+func (s *studentService) Store(ctx context.Context, student *model.Student) error {
+	ctx, span := startSpan(ctx, "StudentService.Store")
+	defer span.End()
+
+	if _, err := authorize(ctx, model.ScopeStudentsWrite, ""); err != nil {
 		return err
 	}
 
-	return nil
+	return s.transactor.Transaction(ctx, func(ctx context.Context) error {
+		err := s.studentRepository.Store(ctx, student)
+		if err != nil {
+			return err
+		}
+
+		return s.audit(ctx, model.AuditActionCreate, int(student.ID), nil, student)
+	})
 }
 
-func (s *studentService) Update(id int, student *model.Student) error {
-	err := s.studentRepository.Update(id, student)
+// Update changes the student if it is still at version and returns it as
+// stored. It fails with ErrStudentChanged when the student has moved on to a
+// newer version in the meantime.
+func (s *studentService) Update(ctx context.Context, id int, student *model.Student, version int) (*model.Student, error) {
+	ctx, span := startSpan(ctx, "StudentService.Update")
+	defer span.End()
+
+	if _, err := authorize(ctx, model.ScopeStudentsWrite, ""); err != nil {
+		return nil, err
+	}
+
+	return s.update(ctx, id, version, func(ctx context.Context, version int) error {
+		return s.studentRepository.Update(ctx, id, student, version)
+	})
+}
+
+// Patch applies a JSON Merge Patch to the student if it is still at version
+// and returns it as stored. Only name, address and class_id can be patched,
+// and name cannot be cleared; anything else fails with ErrInvalidPatch.
+func (s *studentService) Patch(ctx context.Context, id int, patch model.StudentPatch, version int) (*model.Student, error) {
+	ctx, span := startSpan(ctx, "StudentService.Patch")
+	defer span.End()
+
+	if _, err := authorize(ctx, model.ScopeStudentsWrite, ""); err != nil {
+		return nil, err
+	}
+
+	columns, err := studentPatchColumns(patch)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	// An empty patch changes nothing, so it neither bumps the version nor
+	// leaves an audit event; If-Match still has to hold.
+	if len(columns) == 0 {
+		current, err := s.studentRepository.FetchByID(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if version != AnyVersion && current.Version != version {
+			return nil, ErrStudentChanged
+		}
+		return current, nil
 	}
 
-	return nil
+	return s.update(ctx, id, version, func(ctx context.Context, version int) error {
+		return s.studentRepository.Patch(ctx, id, columns, version)
+	})
 }
 
-func (s *studentService) Delete(id int) error {
-	err := s.studentRepository.Delete(id)
+// update runs write against the student at version in a transaction, audits
+// the change and returns the student as stored. AnyVersion writes over
+// whichever version was just read.
+func (s *studentService) update(ctx context.Context, id int, version int, write func(ctx context.Context, version int) error) (*model.Student, error) {
+	var after *model.Student
+	err := s.transactor.Transaction(ctx, func(ctx context.Context) error {
+		before, err := s.studentRepository.FetchByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		if version == AnyVersion {
+			version = before.Version
+		}
+
+		err = write(ctx, version)
+		if errors.Is(err, repository.ErrVersionMismatch) {
+			return ErrStudentChanged
+		}
+		if err != nil {
+			return err
+		}
+
+		after, err = s.studentRepository.FetchByID(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		return s.audit(ctx, model.AuditActionUpdate, id, before, after)
+	})
 	if err != nil {
+		return nil, err
+	}
+	return after, nil
+}
+
+func (s *studentService) Delete(ctx context.Context, id int) error {
+	ctx, span := startSpan(ctx, "StudentService.Delete")
+	defer span.End()
+
+	if _, err := authorize(ctx, model.ScopeStudentsWrite, ""); err != nil {
 		return err
 	}
 
-	return nil
+	return s.transactor.Transaction(ctx, func(ctx context.Context) error {
+		before, err := s.studentRepository.FetchByID(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		err = s.studentRepository.Delete(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		return s.audit(ctx, model.AuditActionDelete, id, before, nil)
+	})
 }
 
-func (s *studentService) FetchWithClass() (*[]model.StudentClass, error) {
-	studentClasses, err := s.studentRepository.FetchWithClass()
+func (s *studentService) FetchWithClass(ctx context.Context) (*[]model.StudentClass, error) {
+	ctx, span := startSpan(ctx, "StudentService.FetchWithClass")
+	defer span.End()
+
+	studentClasses, err := s.studentRepository.FetchWithClass(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -76,3 +211,154 @@ func (s *studentService) FetchWithClass() (*[]model.StudentClass, error) {
 	return studentClasses, nil
 }
 
+func (s *studentService) FetchByClass(ctx context.Context, classID int) ([]model.Student, error) {
+	ctx, span := startSpan(ctx, "StudentService.FetchByClass")
+	defer span.End()
+
+	students, err := s.studentRepository.FetchByClass(ctx, classID)
+	if err != nil {
+		return nil, err
+	}
+
+	return students, nil
+}
+
+func (s *studentService) Trash(ctx context.Context, limit, offset int) ([]model.Student, error) {
+	ctx, span := startSpan(ctx, "StudentService.Trash")
+	defer span.End()
+
+	if _, err := authorize(ctx, model.ScopeStudentsRead, ""); err != nil {
+		return nil, err
+	}
+	return s.studentRepository.FetchTrash(ctx, limit, offset)
+}
+
+func (s *studentService) Restore(ctx context.Context, id int) (*model.Student, error) {
+	ctx, span := startSpan(ctx, "StudentService.Restore")
+	defer span.End()
+
+	if _, err := authorize(ctx, model.ScopeStudentsWrite, ""); err != nil {
+		return nil, err
+	}
+
+	var after *model.Student
+	err := s.transactor.Transaction(ctx, func(ctx context.Context) error {
+		before, err := s.studentRepository.FetchDeletedByID(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		err = s.studentRepository.Restore(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		after, err = s.studentRepository.FetchByID(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		return s.audit(ctx, model.AuditActionRestore, id, before, after)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return after, nil
+}
+
+// Purge permanently deletes a student that is already in the trash. Only
+// admins may purge.
+func (s *studentService) Purge(ctx context.Context, id int) error {
+	ctx, span := startSpan(ctx, "StudentService.Purge")
+	defer span.End()
+
+	if _, err := authorize(ctx, model.ScopeStudentsWrite, model.RoleAdmin); err != nil {
+		return err
+	}
+
+	return s.transactor.Transaction(ctx, func(ctx context.Context) error {
+		before, err := s.studentRepository.FetchDeletedByID(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		err = s.studentRepository.Purge(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		return s.audit(ctx, model.AuditActionPurge, id, before, nil)
+	})
+}
+
+// PurgeTrash permanently deletes the students that have been in the trash
+// for longer than olderThan, or the configured retention when it is zero.
+func (s *studentService) PurgeTrash(ctx context.Context, olderThan time.Duration) (int64, error) {
+	ctx, span := startSpan(ctx, "StudentService.PurgeTrash")
+	defer span.End()
+
+	if _, err := authorize(ctx, model.ScopeStudentsWrite, model.RoleAdmin); err != nil {
+		return 0, err
+	}
+	if olderThan <= 0 {
+		olderThan = s.config.TrashRetention
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	var purged int64
+	err := s.transactor.Transaction(ctx, func(ctx context.Context) error {
+		var err error
+		purged, err = s.studentRepository.PurgeDeletedBefore(ctx, cutoff)
+		if err != nil {
+			return err
+		}
+
+		event := model.AuditEvent{Action: model.AuditActionPurge, Entity: model.AuditEntityStudent}
+		summary := map[string]any{"deleted_before": cutoff, "purged": purged}
+		return s.auditService.Record(ctx, event, nil, summary)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+// studentPatchColumns turns a merge patch into the columns to write. A null
+// clears address to "" and class_id to 0.
+func studentPatchColumns(patch model.StudentPatch) (map[string]any, error) {
+	columns := make(map[string]any, len(patch))
+	for field, raw := range patch {
+		switch field {
+		case "name", "address":
+			var text *string
+			if err := json.Unmarshal(raw, &text); err != nil {
+				return nil, fmt.Errorf("%w: %s must be a string", ErrInvalidPatch, field)
+			}
+			if text == nil {
+				text = new(string)
+			}
+			columns[field] = *text
+		case "class_id":
+			var classID *int
+			if err := json.Unmarshal(raw, &classID); err != nil {
+				return nil, fmt.Errorf("%w: %s must be an integer", ErrInvalidPatch, field)
+			}
+			if classID == nil {
+				classID = new(int)
+			}
+			columns[field] = *classID
+		default:
+			return nil, fmt.Errorf("%w: %s cannot be patched", ErrInvalidPatch, field)
+		}
+	}
+
+	if name, ok := columns["name"]; ok && name == "" {
+		return nil, fmt.Errorf("%w: name cannot be cleared", ErrInvalidPatch)
+	}
+	return columns, nil
+}
+
+func (s *studentService) audit(ctx context.Context, action string, id int, before, after *model.Student) error {
+	event := model.AuditEvent{Action: action, Entity: model.AuditEntityStudent, EntityID: strconv.Itoa(id)}
+	return s.auditService.Record(ctx, event, before, after)
+}
@@ -0,0 +1,272 @@
+package service
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"a21hc3NpZ25tZW50/repository"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	AlgorithmHS256 = "HS256"
+	AlgorithmEdDSA = "EdDSA"
+
+	// revocationSyncInterval bounds how stale the local revocation list may
+	// get relative to revocations made by other server instances.
+	revocationSyncInterval = 30 * time.Second
+)
+
+type TokenService interface {
+	IssueAccessToken(ctx context.Context, session model.Session, user model.User) (string, time.Time, error)
+	VerifyAccessToken(ctx context.Context, token string) (model.AccessClaims, error)
+	RevokeAccessToken(ctx context.Context, claims model.AccessClaims) error
+	RevokeSession(ctx context.Context, sessionID uint) error
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+type tokenService struct {
+	revokedTokenRepository repository.RevokedTokenRepository
+	config                 model.JWTConfig
+
+	mu         sync.RWMutex
+	revoked    map[string]time.Time
+	lastSynced time.Time
+}
+
+func NewTokenService(revokedTokenRepository repository.RevokedTokenRepository, config model.JWTConfig) (TokenService, error) {
+	if config.Algorithm != AlgorithmHS256 && config.Algorithm != AlgorithmEdDSA {
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", config.Algorithm)
+	}
+	if _, ok := config.Keys[config.ActiveKeyID]; !ok {
+		return nil, fmt.Errorf("active JWT key %q is not configured", config.ActiveKeyID)
+	}
+	for kid, key := range config.Keys {
+		if config.Algorithm == AlgorithmEdDSA && len(key) != ed25519.SeedSize {
+			return nil, fmt.Errorf("JWT key %q must be a %d byte Ed25519 seed", kid, ed25519.SeedSize)
+		}
+		if config.Algorithm == AlgorithmHS256 && len(key) < 32 {
+			return nil, fmt.Errorf("JWT key %q must be at least 32 bytes", kid)
+		}
+	}
+	if config.AccessTTL <= 0 {
+		config.AccessTTL = 15 * time.Minute
+	}
+
+	return &tokenService{
+		revokedTokenRepository: revokedTokenRepository,
+		config:                 config,
+		revoked:                map[string]time.Time{},
+	}, nil
+}
+
+// IssueAccessToken signs a short-lived access token for the session, which
+// acts as the refresh token. The token is signed with the active key and
+// names it in the "kid" header so older keys keep verifying after rotation.
+// The user's ID and role ride along so requests need no user lookup; they are
+// re-read from the database at every refresh.
+func (s *tokenService) IssueAccessToken(ctx context.Context, session model.Session, user model.User) (string, time.Time, error) {
+	_, span := startSpan(ctx, "TokenService.IssueAccessToken")
+	defer span.End()
+
+	now := time.Now()
+	expiresAt := now.Add(s.config.AccessTTL)
+	if expiresAt.After(session.Expiry) {
+		expiresAt = session.Expiry
+	}
+
+	claims := model.AccessClaims{
+		Issuer:    s.config.Issuer,
+		Subject:   session.Username,
+		UserID:    user.ID,
+		Role:      user.Role,
+		SessionID: session.ID,
+		ID:        uuid.NewString(),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+	}
+
+	header, err := json.Marshal(jwtHeader{Algorithm: s.config.Algorithm, Type: "JWT", KeyID: s.config.ActiveKeyID})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	signingInput := encodeSegment(header) + "." + encodeSegment(payload)
+	signature := s.sign(s.config.Keys[s.config.ActiveKeyID], []byte(signingInput))
+
+	return signingInput + "." + encodeSegment(signature), time.Unix(claims.ExpiresAt, 0), nil
+}
+
+func (s *tokenService) VerifyAccessToken(ctx context.Context, token string) (model.AccessClaims, error) {
+	ctx, span := startSpan(ctx, "TokenService.VerifyAccessToken")
+	defer span.End()
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return model.AccessClaims{}, fmt.Errorf("Invalid Token!")
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return model.AccessClaims{}, fmt.Errorf("Invalid Token!")
+	}
+	if header.Algorithm != s.config.Algorithm {
+		return model.AccessClaims{}, fmt.Errorf("Invalid Token!")
+	}
+	key, ok := s.config.Keys[header.KeyID]
+	if !ok {
+		return model.AccessClaims{}, fmt.Errorf("Invalid Token!")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !s.verify(key, []byte(parts[0]+"."+parts[1]), signature) {
+		return model.AccessClaims{}, fmt.Errorf("Invalid Token!")
+	}
+
+	var claims model.AccessClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return model.AccessClaims{}, fmt.Errorf("Invalid Token!")
+	}
+	if claims.Issuer != s.config.Issuer {
+		return model.AccessClaims{}, fmt.Errorf("Invalid Token!")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return model.AccessClaims{}, fmt.Errorf("Token is Expired!")
+	}
+
+	revoked, err := s.isRevoked(ctx, claims)
+	if err != nil {
+		return model.AccessClaims{}, err
+	}
+	if revoked {
+		return model.AccessClaims{}, fmt.Errorf("Token is Revoked!")
+	}
+
+	return claims, nil
+}
+
+// RevokeAccessToken blocks a single access token until it would have expired
+// on its own.
+func (s *tokenService) RevokeAccessToken(ctx context.Context, claims model.AccessClaims) error {
+	ctx, span := startSpan(ctx, "TokenService.RevokeAccessToken")
+	defer span.End()
+
+	return s.revoke(ctx, "jti:"+claims.ID, time.Unix(claims.ExpiresAt, 0))
+}
+
+// RevokeSession blocks every access token issued for a session. Tokens live
+// at most AccessTTL, so the entry can be dropped after that.
+func (s *tokenService) RevokeSession(ctx context.Context, sessionID uint) error {
+	ctx, span := startSpan(ctx, "TokenService.RevokeSession")
+	defer span.End()
+
+	return s.revoke(ctx, "sid:"+strconv.FormatUint(uint64(sessionID), 10), time.Now().Add(s.config.AccessTTL))
+}
+
+func (s *tokenService) revoke(ctx context.Context, key string, until time.Time) error {
+	if err := s.revokedTokenRepository.Add(ctx, model.RevokedToken{Key: key, ExpiresAt: until}); err != nil {
+		return err
+	}
+
+	// Inside a transaction the row may still be rolled back, so the local
+	// list only learns about it on commit.
+	repository.AfterCommit(ctx, func() {
+		s.mu.Lock()
+		s.revoked[key] = until
+		s.mu.Unlock()
+	})
+	return nil
+}
+
+func (s *tokenService) isRevoked(ctx context.Context, claims model.AccessClaims) (bool, error) {
+	if err := s.syncRevocations(ctx); err != nil {
+		return false, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, jtiRevoked := s.revoked["jti:"+claims.ID]
+	_, sidRevoked := s.revoked["sid:"+strconv.FormatUint(uint64(claims.SessionID), 10)]
+	return jtiRevoked || sidRevoked, nil
+}
+
+// syncRevocations reloads the revocation list from the database at most once
+// per revocationSyncInterval, so revocations made on other instances are
+// picked up without a query on every request.
+func (s *tokenService) syncRevocations(ctx context.Context) error {
+	s.mu.RLock()
+	fresh := time.Since(s.lastSynced) < revocationSyncInterval
+	s.mu.RUnlock()
+	if fresh {
+		return nil
+	}
+
+	now := time.Now()
+	if err := s.revokedTokenRepository.DeleteExpired(ctx, now); err != nil {
+		return err
+	}
+	tokens, err := s.revokedTokenRepository.FetchActive(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	revoked := make(map[string]time.Time, len(tokens))
+	for _, token := range tokens {
+		revoked[token.Key] = token.ExpiresAt
+	}
+
+	s.mu.Lock()
+	s.revoked = revoked
+	s.lastSynced = now
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *tokenService) sign(key, message []byte) []byte {
+	if s.config.Algorithm == AlgorithmEdDSA {
+		return ed25519.Sign(ed25519.NewKeyFromSeed(key), message)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+func (s *tokenService) verify(key, message, signature []byte) bool {
+	if s.config.Algorithm == AlgorithmEdDSA {
+		public := ed25519.NewKeyFromSeed(key).Public().(ed25519.PublicKey)
+		return ed25519.Verify(public, message, signature)
+	}
+	return hmac.Equal(s.sign(key, message), signature)
+}
+
+func encodeSegment(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
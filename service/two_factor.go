@@ -0,0 +1,362 @@
+package service
+
+import (
+	"a21hc3NpZ25tZW50/model"
+	"a21hc3NpZ25tZW50/repository"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrTwoFactorNotEnrolled    = errors.New("Two-factor authentication is not enrolled")
+	ErrTwoFactorAlreadyEnabled = errors.New("Two-factor authentication is already enabled")
+	ErrTwoFactorRequired       = errors.New("Two-factor authentication is required for this role")
+	ErrInvalidTwoFactorCode    = errors.New("Invalid two-factor code")
+	ErrInvalidChallenge        = errors.New("Invalid or expired login challenge")
+)
+
+const recoveryCodeCount = 10
+
+// TwoFactorService manages TOTP second factors. Enrollment stores a pending
+// secret that only becomes active once the user proves their authenticator
+// produces matching codes. Logins of enrolled users stop at a short-lived
+// challenge that is exchanged for a session with a TOTP or recovery code.
+type TwoFactorService interface {
+	Status(ctx context.Context) (model.TwoFactorStatus, error)
+	Enabled(ctx context.Context, username string) (bool, error)
+	Required(ctx context.Context, role string) (bool, error)
+	SetRequired(ctx context.Context, role string, required bool) error
+
+	BeginEnrollment(ctx context.Context, username string) (model.TOTPEnrollment, error)
+	Activate(ctx context.Context, username string, code string) ([]string, error)
+	Disable(ctx context.Context, code string) error
+	Reset(ctx context.Context, username string) error
+
+	CreateChallenge(ctx context.Context, username string) (model.LoginChallengeResponse, error)
+	ChallengeUsername(ctx context.Context, challenge string) (string, error)
+	CompleteChallenge(ctx context.Context, challenge string, code string) (string, error)
+}
+
+type twoFactorService struct {
+	twoFactorRepository   repository.TwoFactorRepository
+	roleSettingRepository repository.RoleSettingRepository
+	config                model.TwoFactorConfig
+}
+
+func NewTwoFactorService(twoFactorRepository repository.TwoFactorRepository, roleSettingRepository repository.RoleSettingRepository, config model.TwoFactorConfig) TwoFactorService {
+	if config.Issuer == "" {
+		config.Issuer = "student-portal"
+	}
+	if config.ChallengeTTL <= 0 {
+		config.ChallengeTTL = 5 * time.Minute
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 5
+	}
+	return &twoFactorService{twoFactorRepository, roleSettingRepository, config}
+}
+
+// Status reports whether the caller has a second factor and whether any of
+// their roles requires one.
+func (s *twoFactorService) Status(ctx context.Context) (model.TwoFactorStatus, error) {
+	ctx, span := startSpan(ctx, "TwoFactorService.Status")
+	defer span.End()
+
+	principal, ok := model.PrincipalFrom(ctx)
+	if !ok {
+		return model.TwoFactorStatus{}, ErrUnauthenticated
+	}
+
+	enabled, err := s.Enabled(ctx, principal.Username)
+	if err != nil {
+		return model.TwoFactorStatus{}, err
+	}
+	required, err := s.requiredFor(ctx, principal)
+	if err != nil {
+		return model.TwoFactorStatus{}, err
+	}
+	return model.TwoFactorStatus{Enabled: enabled, Required: required}, nil
+}
+
+func (s *twoFactorService) requiredFor(ctx context.Context, principal model.Principal) (bool, error) {
+	for _, role := range principal.Roles {
+		required, err := s.Required(ctx, role)
+		if err != nil || required {
+			return required, err
+		}
+	}
+	return false, nil
+}
+
+func (s *twoFactorService) Enabled(ctx context.Context, username string) (bool, error) {
+	ctx, span := startSpan(ctx, "TwoFactorService.Enabled")
+	defer span.End()
+
+	twoFactor, err := s.twoFactorRepository.Fetch(ctx, username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	return twoFactor.Enabled, err
+}
+
+func (s *twoFactorService) Required(ctx context.Context, role string) (bool, error) {
+	ctx, span := startSpan(ctx, "TwoFactorService.Required")
+	defer span.End()
+
+	setting, err := s.roleSettingRepository.Fetch(ctx, role)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	return setting.RequireTwoFactor, err
+}
+
+func (s *twoFactorService) SetRequired(ctx context.Context, role string, required bool) error {
+	ctx, span := startSpan(ctx, "TwoFactorService.SetRequired")
+	defer span.End()
+
+	if role != model.RoleUser && role != model.RoleAdmin {
+		return fmt.Errorf("unknown role %q", role)
+	}
+	return s.roleSettingRepository.Save(ctx, model.RoleSetting{Role: role, RequireTwoFactor: required})
+}
+
+// BeginEnrollment generates a new secret, replacing any earlier enrollment
+// that was never activated.
+func (s *twoFactorService) BeginEnrollment(ctx context.Context, username string) (model.TOTPEnrollment, error) {
+	ctx, span := startSpan(ctx, "TwoFactorService.BeginEnrollment")
+	defer span.End()
+
+	enabled, err := s.Enabled(ctx, username)
+	if err != nil {
+		return model.TOTPEnrollment{}, err
+	}
+	if enabled {
+		return model.TOTPEnrollment{}, ErrTwoFactorAlreadyEnabled
+	}
+
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return model.TOTPEnrollment{}, err
+	}
+	secret := totpEncoding.EncodeToString(key)
+
+	if err := s.twoFactorRepository.Save(ctx, model.TwoFactor{Username: username, Secret: secret}); err != nil {
+		return model.TOTPEnrollment{}, err
+	}
+
+	return model.TOTPEnrollment{Secret: secret, URI: totpURI(s.config.Issuer, username, secret)}, nil
+}
+
+// Activate turns on the pending secret once code matches it, and returns a
+// fresh set of recovery codes. Only their hashes are stored, so this is the
+// only time they can be shown.
+func (s *twoFactorService) Activate(ctx context.Context, username string, code string) ([]string, error) {
+	ctx, span := startSpan(ctx, "TwoFactorService.Activate")
+	defer span.End()
+
+	twoFactor, err := s.twoFactorRepository.Fetch(ctx, username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrTwoFactorNotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if twoFactor.Enabled {
+		return nil, ErrTwoFactorAlreadyEnabled
+	}
+
+	step, ok := matchTOTP(twoFactor.Secret, normalizeCode(code), time.Now())
+	if !ok {
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := randomHex(5)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashSecret(code))
+	}
+
+	if err := s.twoFactorRepository.Enable(ctx, username, time.Now(), step, hashes); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrTwoFactorAlreadyEnabled
+		}
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+func (s *twoFactorService) Disable(ctx context.Context, code string) error {
+	ctx, span := startSpan(ctx, "TwoFactorService.Disable")
+	defer span.End()
+
+	principal, err := authorize(ctx, model.ScopeAccount, "")
+	if err != nil {
+		return err
+	}
+
+	required, err := s.requiredFor(ctx, principal)
+	if err != nil {
+		return err
+	}
+	if required {
+		return ErrTwoFactorRequired
+	}
+
+	if err := s.verify(ctx, principal.Username, code); err != nil {
+		return err
+	}
+	return s.twoFactorRepository.Delete(ctx, principal.Username)
+}
+
+// Reset removes the second factor without asking for a code, for accounts
+// that are being deleted.
+func (s *twoFactorService) Reset(ctx context.Context, username string) error {
+	ctx, span := startSpan(ctx, "TwoFactorService.Reset")
+	defer span.End()
+
+	return s.twoFactorRepository.Delete(ctx, username)
+}
+
+func (s *twoFactorService) CreateChallenge(ctx context.Context, username string) (model.LoginChallengeResponse, error) {
+	ctx, span := startSpan(ctx, "TwoFactorService.CreateChallenge")
+	defer span.End()
+
+	now := time.Now()
+	if err := s.twoFactorRepository.DeleteExpiredChallenges(ctx, username, now); err != nil {
+		return model.LoginChallengeResponse{}, err
+	}
+
+	token, err := randomHex(32)
+	if err != nil {
+		return model.LoginChallengeResponse{}, err
+	}
+
+	challenge := model.LoginChallenge{
+		Username:  username,
+		Hash:      hashSecret(token),
+		ExpiresAt: now.Add(s.config.ChallengeTTL),
+	}
+	if err := s.twoFactorRepository.AddChallenge(ctx, &challenge); err != nil {
+		return model.LoginChallengeResponse{}, err
+	}
+
+	return model.LoginChallengeResponse{
+		Username:  username,
+		Challenge: token,
+		ExpiresAt: challenge.ExpiresAt,
+		Message:   "Two-factor code required",
+	}, nil
+}
+
+// ChallengeUsername returns the user behind a live challenge without using
+// up an attempt, so the caller can check the lockout before a code is tried.
+func (s *twoFactorService) ChallengeUsername(ctx context.Context, token string) (string, error) {
+	ctx, span := startSpan(ctx, "TwoFactorService.ChallengeUsername")
+	defer span.End()
+
+	challenge, err := s.twoFactorRepository.FetchChallenge(ctx, hashSecret(token), time.Now())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", ErrInvalidChallenge
+	}
+	if err != nil {
+		return "", err
+	}
+	return challenge.Username, nil
+}
+
+// CompleteChallenge checks code against the user behind the challenge and
+// returns their username. The username is also returned alongside
+// ErrInvalidTwoFactorCode so the caller can count the failure. A challenge is
+// discarded once used or after MaxAttempts wrong codes.
+func (s *twoFactorService) CompleteChallenge(ctx context.Context, token string, code string) (string, error) {
+	ctx, span := startSpan(ctx, "TwoFactorService.CompleteChallenge")
+	defer span.End()
+
+	challenge, err := s.twoFactorRepository.FetchChallenge(ctx, hashSecret(token), time.Now())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", ErrInvalidChallenge
+	}
+	if err != nil {
+		return "", err
+	}
+
+	attempts, err := s.twoFactorRepository.CountChallengeAttempt(ctx, challenge.ID)
+	if err != nil {
+		return "", err
+	}
+	if attempts > s.config.MaxAttempts {
+		s.twoFactorRepository.DeleteChallenge(ctx, challenge.ID)
+		return "", ErrInvalidChallenge
+	}
+
+	if err := s.verify(ctx, challenge.Username, code); err != nil {
+		return challenge.Username, err
+	}
+
+	return challenge.Username, s.twoFactorRepository.DeleteChallenge(ctx, challenge.ID)
+}
+
+// verify accepts either a current TOTP code, each of which works only once,
+// or an unused recovery code.
+func (s *twoFactorService) verify(ctx context.Context, username string, code string) error {
+	twoFactor, err := s.twoFactorRepository.Fetch(ctx, username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrTwoFactorNotEnrolled
+	}
+	if err != nil {
+		return err
+	}
+	if !twoFactor.Enabled {
+		return ErrTwoFactorNotEnrolled
+	}
+
+	code = normalizeCode(code)
+	if len(code) == totpDigits {
+		step, ok := matchTOTP(twoFactor.Secret, code, time.Now())
+		if !ok {
+			return ErrInvalidTwoFactorCode
+		}
+		err = s.twoFactorRepository.AdvanceStep(ctx, username, step)
+	} else {
+		err = s.twoFactorRepository.UseRecoveryCode(ctx, username, hashSecret(code), time.Now())
+	}
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrInvalidTwoFactorCode
+	}
+	return err
+}
+
+// matchTOTP accepts codes from the previous and next time step as well, to
+// tolerate clock drift between the server and the authenticator.
+func matchTOTP(secret string, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return 0, false
+	}
+
+	current := totpStep(now)
+	for step := current - 1; step <= current+1; step++ {
+		if hmac.Equal([]byte(totpAt(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
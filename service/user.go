@@ -3,51 +3,434 @@ package service
 import (
 	"a21hc3NpZ25tZW50/model"
 	"a21hc3NpZ25tZW50/repository"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrWrongPassword     = errors.New("Wrong User or Password!")
+	ErrAccountDisabled   = errors.New("Account is disabled")
+	ErrInvalidResetToken = errors.New("Invalid or expired reset token")
+	ErrInvalidProfile    = errors.New("Invalid profile")
+	ErrDisableSelf       = errors.New("Admins cannot disable their own account")
 )
 
 type UserService interface {
-	Login(user model.User) error
-	Register(user model.User) error
+	Login(ctx context.Context, user model.User) error
+	Register(ctx context.Context, user model.User) error
+	FetchByUsername(ctx context.Context, username string) (model.User, error)
+	SetRole(ctx context.Context, username string, role string) error
 
-	CheckPassLength(pass string) bool
-	CheckPassAlphabet(pass string) bool
+	ChangePassword(ctx context.Context, request model.PasswordChangeRequest) error
+	RequestPasswordReset(ctx context.Context, username string) error
+	ResetPassword(ctx context.Context, request model.PasswordResetConfirm) (string, error)
+
+	Profile(ctx context.Context) (model.UserProfile, error)
+	UpdateProfile(ctx context.Context, update model.ProfileUpdate) (model.UserProfile, error)
+	RecordLogin(ctx context.Context, username string) error
+	DeleteAccount(ctx context.Context, password string) error
+	ListUsers(ctx context.Context, limit, offset int) ([]model.UserProfile, error)
+	SetDisabled(ctx context.Context, username string, disabled bool) error
 }
 
 type userService struct {
-	userRepository repository.UserRepository
+	userRepository          repository.UserRepository
+	passwordResetRepository repository.PasswordResetRepository
+	passwordPolicy          PasswordPolicy
+	notifier                Notifier
+	auditService            AuditService
+	transactor              repository.Transactor
+	config                  model.PasswordResetConfig
 }
 
-func NewUserService(userRepository repository.UserRepository) UserService {
-	return &userService{userRepository}
+func NewUserService(userRepository repository.UserRepository, passwordResetRepository repository.PasswordResetRepository, passwordPolicy PasswordPolicy, notifier Notifier, auditService AuditService, transactor repository.Transactor, config model.PasswordResetConfig) UserService {
+	if config.TokenTTL <= 0 {
+		config.TokenTTL = 30 * time.Minute
+	}
+	return &userService{userRepository, passwordResetRepository, passwordPolicy, notifier, auditService, transactor, config}
 }
 
-func (s *userService) Login(user model.User) error {
-	err := s.userRepository.CheckAvail(user)
+func (s *userService) Login(ctx context.Context, user model.User) error {
+	ctx, span := startSpan(ctx, "UserService.Login")
+	defer span.End()
+
+	found, err := s.userRepository.FetchByUsername(ctx, user.Username)
 	if err != nil {
 		return err
 	}
 
+	if subtle.ConstantTimeCompare([]byte(found.Password), []byte(user.Password)) != 1 {
+		return ErrWrongPassword
+	}
+	if found.Disabled {
+		return ErrAccountDisabled
+	}
+
 	return nil
 }
 
-func (s *userService) Register(user model.User) error {
-	err := s.userRepository.Add(user)
+func (s *userService) FetchByUsername(ctx context.Context, username string) (model.User, error) {
+	ctx, span := startSpan(ctx, "UserService.FetchByUsername")
+	defer span.End()
+
+	return s.userRepository.FetchByUsername(ctx, username)
+}
+
+func (s *userService) SetRole(ctx context.Context, username string, role string) error {
+	ctx, span := startSpan(ctx, "UserService.SetRole")
+	defer span.End()
+
+	if role != model.RoleUser && role != model.RoleAdmin {
+		return fmt.Errorf("unknown role %q", role)
+	}
+
+	return s.transactor.Transaction(ctx, func(ctx context.Context) error {
+		before, err := s.profile(ctx, username)
+		if err != nil {
+			return err
+		}
+		if err := s.userRepository.UpdateRole(ctx, username, role); err != nil {
+			return err
+		}
+		after, err := s.profile(ctx, username)
+		if err != nil {
+			return err
+		}
+
+		return s.audit(ctx, "", model.AuditActionUpdate, username, before, after)
+	})
+}
+
+func (s *userService) Register(ctx context.Context, user model.User) error {
+	ctx, span := startSpan(ctx, "UserService.Register")
+	defer span.End()
+
+	if err := s.passwordPolicy.Validate(user.Username, user.Password); err != nil {
+		return err
+	}
+
+	// Only the credentials and profile come from the client; privileged and
+	// server-managed fields always start out at their defaults.
+	user = model.User{
+		Username:    user.Username,
+		Password:    user.Password,
+		DisplayName: user.DisplayName,
+		Email:       user.Email,
+		Role:        model.RoleUser,
+	}
+	return s.transactor.Transaction(ctx, func(ctx context.Context) error {
+		err := s.userRepository.Add(ctx, user)
+		if err != nil {
+			return err
+		}
+
+		created, err := s.profile(ctx, user.Username)
+		if err != nil {
+			return err
+		}
+		return s.audit(ctx, user.Username, model.AuditActionCreate, user.Username, nil, created)
+	})
+}
+
+func (s *userService) ChangePassword(ctx context.Context, request model.PasswordChangeRequest) error {
+	ctx, span := startSpan(ctx, "UserService.ChangePassword")
+	defer span.End()
+
+	principal, err := authorize(ctx, model.ScopeAccount, "")
 	if err != nil {
 		return err
 	}
+	username := principal.Username
 
-	return nil
+	if err := s.Login(ctx, model.User{Username: username, Password: request.CurrentPassword}); err != nil {
+		return err
+	}
+	if err := s.passwordPolicy.Validate(username, request.NewPassword); err != nil {
+		return err
+	}
+
+	return s.transactor.Transaction(ctx, func(ctx context.Context) error {
+		if err := s.userRepository.UpdatePassword(ctx, username, request.NewPassword); err != nil {
+			return err
+		}
+		return s.audit(ctx, "", model.AuditActionPasswordChange, username, nil, nil)
+	})
+}
+
+// RequestPasswordReset replaces any outstanding reset token of the user with
+// a new one and hands it to the notifier. Only a hash of the token is stored.
+// Unknown usernames are ignored so the endpoint does not reveal which accounts
+// exist.
+func (s *userService) RequestPasswordReset(ctx context.Context, username string) error {
+	ctx, span := startSpan(ctx, "UserService.RequestPasswordReset")
+	defer span.End()
+
+	user, err := s.userRepository.FetchByUsername(ctx, username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.Disabled {
+		return nil
+	}
+
+	token, err := randomHex(32)
+	if err != nil {
+		return err
+	}
+
+	reset := model.PasswordResetToken{
+		Username:  username,
+		Hash:      hashSecret(token),
+		ExpiresAt: time.Now().Add(s.config.TokenTTL),
+	}
+	err = s.transactor.Transaction(ctx, func(ctx context.Context) error {
+		if err := s.passwordResetRepository.DeleteByUsername(ctx, username); err != nil {
+			return err
+		}
+		return s.passwordResetRepository.Add(ctx, &reset)
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.notifier.SendPasswordReset(username, token, reset.ExpiresAt)
+}
+
+// ResetPassword sets a new password using a reset token and returns the
+// username it belonged to. The token is only consumed once the new password
+// passes the policy.
+func (s *userService) ResetPassword(ctx context.Context, request model.PasswordResetConfirm) (string, error) {
+	ctx, span := startSpan(ctx, "UserService.ResetPassword")
+	defer span.End()
+
+	now := time.Now()
+	reset, err := s.passwordResetRepository.FetchActive(ctx, hashSecret(request.Token), now)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", ErrInvalidResetToken
+		}
+		return "", err
+	}
+
+	if err := s.passwordPolicy.Validate(reset.Username, request.NewPassword); err != nil {
+		return "", err
+	}
+
+	err = s.transactor.Transaction(ctx, func(ctx context.Context) error {
+		if err := s.passwordResetRepository.MarkUsed(ctx, reset.ID, now); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidResetToken
+			}
+			return err
+		}
+
+		if err := s.userRepository.UpdatePassword(ctx, reset.Username, request.NewPassword); err != nil {
+			return err
+		}
+		return s.audit(ctx, reset.Username, model.AuditActionPasswordReset, reset.Username, nil, nil)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return reset.Username, nil
+}
+
+func (s *userService) Profile(ctx context.Context) (model.UserProfile, error) {
+	ctx, span := startSpan(ctx, "UserService.Profile")
+	defer span.End()
+
+	principal, err := authorize(ctx, model.ScopeAccount, "")
+	if err != nil {
+		return model.UserProfile{}, err
+	}
+
+	user, err := s.userRepository.FetchByUsername(ctx, principal.Username)
+	if err != nil {
+		return model.UserProfile{}, err
+	}
+	return profileOf(user), nil
+}
+
+func (s *userService) UpdateProfile(ctx context.Context, update model.ProfileUpdate) (model.UserProfile, error) {
+	ctx, span := startSpan(ctx, "UserService.UpdateProfile")
+	defer span.End()
+
+	principal, err := authorize(ctx, model.ScopeAccount, "")
+	if err != nil {
+		return model.UserProfile{}, err
+	}
+
+	if update.DisplayName != nil {
+		name := strings.TrimSpace(*update.DisplayName)
+		if utf8.RuneCountInString(name) > 100 {
+			return model.UserProfile{}, fmt.Errorf("%w: display_name must be at most 100 characters", ErrInvalidProfile)
+		}
+		update.DisplayName = &name
+	}
+	if update.Email != nil && *update.Email != "" {
+		address, err := mail.ParseAddress(*update.Email)
+		if err != nil || address.Address != *update.Email {
+			return model.UserProfile{}, fmt.Errorf("%w: email is not a valid address", ErrInvalidProfile)
+		}
+	}
+
+	var after *model.UserProfile
+	err = s.transactor.Transaction(ctx, func(ctx context.Context) error {
+		before, err := s.profile(ctx, principal.Username)
+		if err != nil {
+			return err
+		}
+		if err := s.userRepository.UpdateProfile(ctx, principal.Username, update); err != nil {
+			return err
+		}
+		after, err = s.profile(ctx, principal.Username)
+		if err != nil {
+			return err
+		}
+
+		return s.audit(ctx, "", model.AuditActionUpdate, principal.Username, before, after)
+	})
+	if err != nil {
+		return model.UserProfile{}, err
+	}
+	return *after, nil
+}
+
+func (s *userService) RecordLogin(ctx context.Context, username string) error {
+	ctx, span := startSpan(ctx, "UserService.RecordLogin")
+	defer span.End()
+
+	return s.transactor.Transaction(ctx, func(ctx context.Context) error {
+		if err := s.userRepository.UpdateLastLogin(ctx, username, time.Now()); err != nil {
+			return err
+		}
+		return s.audit(ctx, username, model.AuditActionLogin, username, nil, nil)
+	})
+}
+
+// DeleteAccount removes the user after confirming their password. Sessions,
+// API keys and second factors are owned by other services and must be
+// cleaned up by the caller, in the same transaction.
+func (s *userService) DeleteAccount(ctx context.Context, password string) error {
+	ctx, span := startSpan(ctx, "UserService.DeleteAccount")
+	defer span.End()
+
+	principal, err := authorize(ctx, model.ScopeAccount, "")
+	if err != nil {
+		return err
+	}
+	username := principal.Username
+
+	if err := s.Login(ctx, model.User{Username: username, Password: password}); err != nil {
+		return err
+	}
+	return s.transactor.Transaction(ctx, func(ctx context.Context) error {
+		before, err := s.profile(ctx, username)
+		if err != nil {
+			return err
+		}
+		if err := s.passwordResetRepository.DeleteByUsername(ctx, username); err != nil {
+			return err
+		}
+		if err := s.userRepository.Delete(ctx, username); err != nil {
+			return err
+		}
+
+		return s.audit(ctx, "", model.AuditActionDelete, username, before, nil)
+	})
 }
 
-func (s *userService) CheckPassLength(pass string) bool {
-	return len(pass) <= 5
+func (s *userService) ListUsers(ctx context.Context, limit, offset int) ([]model.UserProfile, error) {
+	ctx, span := startSpan(ctx, "UserService.ListUsers")
+	defer span.End()
+
+	if _, err := authorize(ctx, model.ScopeAccount, model.RoleAdmin); err != nil {
+		return nil, err
+	}
+
+	users, err := s.userRepository.FetchAll(ctx, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := make([]model.UserProfile, 0, len(users))
+	for _, user := range users {
+		profiles = append(profiles, profileOf(user))
+	}
+	return profiles, nil
 }
 
-func (s *userService) CheckPassAlphabet(pass string) bool {
-	for _, charVariable := range pass {
-		if (charVariable < 'a' || charVariable > 'z') && (charVariable < 'A' || charVariable > 'Z') {
-			return false
+// SetDisabled lets an admin disable or re-enable another user's account.
+func (s *userService) SetDisabled(ctx context.Context, username string, disabled bool) error {
+	ctx, span := startSpan(ctx, "UserService.SetDisabled")
+	defer span.End()
+
+	principal, err := authorize(ctx, model.ScopeAccount, model.RoleAdmin)
+	if err != nil {
+		return err
+	}
+	if disabled && principal.Username == username {
+		return ErrDisableSelf
+	}
+
+	action := model.AuditActionEnable
+	if disabled {
+		action = model.AuditActionDisable
+	}
+	return s.transactor.Transaction(ctx, func(ctx context.Context) error {
+		before, err := s.profile(ctx, username)
+		if err != nil {
+			return err
+		}
+		if err := s.userRepository.SetDisabled(ctx, username, disabled); err != nil {
+			return err
 		}
+		after, err := s.profile(ctx, username)
+		if err != nil {
+			return err
+		}
+
+		return s.audit(ctx, "", action, username, before, after)
+	})
+}
+
+func (s *userService) profile(ctx context.Context, username string) (*model.UserProfile, error) {
+	user, err := s.userRepository.FetchByUsername(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	profile := profileOf(user)
+	return &profile, nil
+}
+
+// audit records a change to the user. actor names the caller for the
+// unauthenticated flows, such as registration; otherwise it is left empty and
+// taken from the principal.
+func (s *userService) audit(ctx context.Context, actor, action, username string, before, after *model.UserProfile) error {
+	event := model.AuditEvent{Actor: actor, Action: action, Entity: model.AuditEntityUser, EntityID: username}
+	return s.auditService.Record(ctx, event, before, after)
+}
+
+func profileOf(user model.User) model.UserProfile {
+	return model.UserProfile{
+		Username:    user.Username,
+		DisplayName: user.DisplayName,
+		Email:       user.Email,
+		Role:        user.Role,
+		Disabled:    user.Disabled,
+		CreatedAt:   user.CreatedAt,
+		LastLoginAt: user.LastLoginAt,
 	}
-	return true
 }
@@ -0,0 +1,155 @@
+package main_test
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"a21hc3NpZ25tZW50/model"
+	"a21hc3NpZ25tZW50/service"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type memoryRevokedTokenRepo struct {
+	tokens []model.RevokedToken
+}
+
+func (m *memoryRevokedTokenRepo) Add(_ context.Context, token model.RevokedToken) error {
+	m.tokens = append(m.tokens, token)
+	return nil
+}
+
+func (m *memoryRevokedTokenRepo) FetchActive(_ context.Context, now time.Time) ([]model.RevokedToken, error) {
+	var active []model.RevokedToken
+	for _, token := range m.tokens {
+		if token.ExpiresAt.After(now) {
+			active = append(active, token)
+		}
+	}
+	return active, nil
+}
+
+func (m *memoryRevokedTokenRepo) DeleteExpired(_ context.Context, before time.Time) error {
+	return nil
+}
+
+var _ = Describe("Token service", func() {
+	oldKey := []byte("0123456789abcdef0123456789abcdef")
+	newKey := []byte("fedcba9876543210fedcba9876543210")
+	session := model.Session{Username: "aditira", Expiry: time.Now().Add(time.Hour)}
+	session.ID = 7
+	user := model.User{Username: "aditira", Role: model.RoleAdmin}
+	user.ID = 3
+
+	var revoked *memoryRevokedTokenRepo
+	ctx := context.Background()
+
+	newTokenService := func(config model.JWTConfig) service.TokenService {
+		config.Issuer = "student-portal"
+		tokenService, err := service.NewTokenService(revoked, config)
+		Expect(err).ShouldNot(HaveOccurred())
+		return tokenService
+	}
+
+	BeforeEach(func() {
+		revoked = &memoryRevokedTokenRepo{}
+	})
+
+	It("should issue HS256 access tokens that verify locally", func() {
+		tokenService := newTokenService(model.JWTConfig{
+			Algorithm:   service.AlgorithmHS256,
+			Keys:        map[string][]byte{"k1": oldKey},
+			ActiveKeyID: "k1",
+			AccessTTL:   5 * time.Minute,
+		})
+
+		token, expiresAt, err := tokenService.IssueAccessToken(ctx, session, user)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(expiresAt).To(BeTemporally("~", time.Now().Add(5*time.Minute), time.Second))
+
+		claims, err := tokenService.VerifyAccessToken(ctx, token)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(claims.Subject).To(Equal("aditira"))
+		Expect(claims.SessionID).To(Equal(uint(7)))
+		Expect(claims.UserID).To(Equal(uint(3)))
+		Expect(claims.Role).To(Equal(model.RoleAdmin))
+
+		parts := strings.Split(token, ".")
+		forged := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"student-portal","sub":"admin","sid":7,"exp":9999999999}`)) + "." + parts[2]
+		_, err = tokenService.VerifyAccessToken(ctx, forged)
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should keep verifying tokens signed with a rotated-out key", func() {
+		before := newTokenService(model.JWTConfig{
+			Algorithm:   service.AlgorithmHS256,
+			Keys:        map[string][]byte{"k1": oldKey},
+			ActiveKeyID: "k1",
+		})
+		token, _, err := before.IssueAccessToken(ctx, session, user)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		after := newTokenService(model.JWTConfig{
+			Algorithm:   service.AlgorithmHS256,
+			Keys:        map[string][]byte{"k1": oldKey, "k2": newKey},
+			ActiveKeyID: "k2",
+		})
+		_, err = after.VerifyAccessToken(ctx, token)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		retired := newTokenService(model.JWTConfig{
+			Algorithm:   service.AlgorithmHS256,
+			Keys:        map[string][]byte{"k2": newKey},
+			ActiveKeyID: "k2",
+		})
+		_, err = retired.VerifyAccessToken(ctx, token)
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should sign and verify EdDSA tokens and reject other algorithms", func() {
+		eddsa := newTokenService(model.JWTConfig{
+			Algorithm:   service.AlgorithmEdDSA,
+			Keys:        map[string][]byte{"k1": oldKey},
+			ActiveKeyID: "k1",
+		})
+		token, _, err := eddsa.IssueAccessToken(ctx, session, user)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		_, err = eddsa.VerifyAccessToken(ctx, token)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		hmac := newTokenService(model.JWTConfig{
+			Algorithm:   service.AlgorithmHS256,
+			Keys:        map[string][]byte{"k1": oldKey},
+			ActiveKeyID: "k1",
+		})
+		_, err = hmac.VerifyAccessToken(ctx, token)
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should reject revoked tokens and tokens of revoked sessions", func() {
+		tokenService := newTokenService(model.JWTConfig{
+			Algorithm:   service.AlgorithmHS256,
+			Keys:        map[string][]byte{"k1": oldKey},
+			ActiveKeyID: "k1",
+		})
+
+		token, _, err := tokenService.IssueAccessToken(ctx, session, user)
+		Expect(err).ShouldNot(HaveOccurred())
+		claims, err := tokenService.VerifyAccessToken(ctx, token)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(tokenService.RevokeAccessToken(ctx, claims)).To(Succeed())
+		_, err = tokenService.VerifyAccessToken(ctx, token)
+		Expect(err).Should(HaveOccurred())
+
+		other, _, err := tokenService.IssueAccessToken(ctx, session, user)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(tokenService.RevokeSession(ctx, session.ID)).To(Succeed())
+		_, err = tokenService.VerifyAccessToken(ctx, other)
+		Expect(err).Should(HaveOccurred())
+	})
+})
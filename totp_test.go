@@ -0,0 +1,34 @@
+package main_test
+
+import (
+	"time"
+
+	"a21hc3NpZ25tZW50/service"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TOTP", func() {
+	// The SHA-1 test secret "12345678901234567890" from RFC 6238, base32 encoded.
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+	It("should produce the RFC 6238 test vectors truncated to six digits", func() {
+		vectors := map[int64]string{
+			59:         "287082",
+			1111111109: "081804",
+			1234567890: "005924",
+			2000000000: "279037",
+		}
+		for unix, expected := range vectors {
+			code, err := service.TOTPCode(secret, time.Unix(unix, 0))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(code).To(Equal(expected))
+		}
+	})
+
+	It("should reject a secret that is not base32", func() {
+		_, err := service.TOTPCode("not base32!", time.Now())
+		Expect(err).To(HaveOccurred())
+	})
+})